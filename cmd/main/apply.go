@@ -0,0 +1,187 @@
+package main
+
+import (
+	"concept/pkg/diff"
+	"concept/pkg/git"
+	"concept/pkg/patches"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+)
+
+// errConflict is returned for a patch whose changes overlap edits made to the
+// file since it was reviewed
+var errConflict = errors.New("changes conflict with edits made since the review")
+
+// errMissingBase is returned for a patch whose reviewed content is no longer
+// in the repository, so it can't be merged into a file that has changed since
+var errMissingBase = errors.New("the reviewed content is not in the repository")
+
+// applyOutcome is what applying a patch did to its file
+type applyOutcome string
+
+const (
+	// The file was unchanged since the review and the patch applied cleanly
+	outcomeApplied applyOutcome = "applied"
+	// The file had changed since the review and the patch was merged in
+	outcomeMerged applyOutcome = "merged"
+	// The file already contains the patch's changes
+	outcomeAlreadyApplied applyOutcome = "already applied"
+)
+
+// apply applies the patches in .patches to the working tree, three-way
+// merging each one against the content it was made from
+func apply(args []string) {
+	var (
+		l      string
+		dryRun bool
+	)
+
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	fs.StringVar(&l, "l", "info", "set log level")
+	fs.BoolVar(&dryRun, "n", false, "report what would happen without changing any files")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: baz apply [flags] [patch files]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	setupLogging(l)
+
+	patchFiles := fs.Args()
+	if len(patchFiles) == 0 {
+		var err error
+		patchFiles, err = patches.NewStore(patches.DefaultDir).List()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to find patches")
+		}
+	}
+
+	var conflicts, failures []string
+	for _, patchFile := range patchFiles {
+		file, outcome, err := applyPatch(patchFile, dryRun)
+		if errors.Is(err, errConflict) {
+			log.Warn().Str("patch", patchFile).Str("file", file).Msg("Patch conflicts, leaving the file alone")
+			conflicts = append(conflicts, file)
+			continue
+		}
+		if errors.Is(err, errMissingBase) {
+			log.Error().Err(err).Str("patch", patchFile).Str("file", file).Msg("File changed since the review and its reviewed content is missing, review it again")
+			failures = append(failures, patchFile)
+			continue
+		}
+		if err != nil {
+			log.Error().Err(err).Str("patch", patchFile).Msg("Failed to apply patch")
+			failures = append(failures, patchFile)
+			continue
+		}
+
+		log.Info().Str("file", file).Str("outcome", string(outcome)).Bool("dry_run", dryRun).Msg("Applied patch")
+	}
+
+	log.Info().
+		Int("patches", len(patchFiles)).
+		Int("conflicts", len(conflicts)).
+		Int("failed", len(failures)).
+		Msg("Finished applying patches")
+
+	if len(conflicts) > 0 || len(failures) > 0 {
+		if len(conflicts) > 0 {
+			log.Warn().Strs("files", conflicts).Msg("Some patches conflicted")
+		}
+		os.Exit(1)
+	}
+}
+
+// applyPatch applies a patch to the file it names. If the file has changed
+// since the review, the patch is merged using the reviewed content as the
+// base, and a conflicting merge leaves the file untouched.
+func applyPatch(patchFile string, dryRun bool) (string, applyOutcome, error) {
+	data, err := os.ReadFile(patchFile)
+	if err != nil {
+		return "", "", err
+	}
+
+	header, hunks, err := diff.Parse(string(data))
+	if err != nil {
+		return "", "", err
+	}
+	file := header.File
+	if !filepath.IsLocal(file) {
+		return file, "", fmt.Errorf("%q is not a path inside the repository", file)
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return file, "", fmt.Errorf("%s no longer exists", file)
+		}
+		return file, "", err
+	}
+
+	current, err := os.ReadFile(file)
+	if err != nil {
+		return file, "", err
+	}
+
+	result, outcome, err := mergePatch(header, hunks, current)
+	if err != nil {
+		return file, "", err
+	}
+	if outcome == outcomeAlreadyApplied {
+		return file, outcome, nil
+	}
+
+	if !dryRun {
+		if err := os.WriteFile(file, []byte(result), info.Mode().Perm()); err != nil {
+			return file, "", err
+		}
+	}
+
+	return file, outcome, nil
+}
+
+// mergePatch returns the result of applying a patch to the current content of
+// its file. If the file has changed since the review, the patch is merged
+// using the reviewed content as the base.
+func mergePatch(header diff.Header, hunks []diff.Hunk, current []byte) (string, applyOutcome, error) {
+	blob := git.HashBlob(current)
+
+	if header.NewBlob != "" && blob == header.NewBlob {
+		return string(current), outcomeAlreadyApplied, nil
+	}
+
+	if header.OldBlob != "" && blob == header.OldBlob {
+		result, err := diff.Apply(string(current), hunks)
+		if err != nil {
+			return "", "", err
+		}
+		return result, outcomeApplied, nil
+	}
+
+	if header.OldBlob == "" {
+		return "", "", fmt.Errorf("patch records no base blob: %w", errMissingBase)
+	}
+	base, err := git.ReadBlob(header.OldBlob)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", errMissingBase, err)
+	}
+
+	theirs, err := diff.Apply(string(base), hunks)
+	if err != nil {
+		return "", "", fmt.Errorf("patch does not match the reviewed content: %w", err)
+	}
+
+	merged, conflicted, err := git.MergeFile(current, base, []byte(theirs))
+	if err != nil {
+		return "", "", err
+	}
+	if conflicted {
+		return "", "", errConflict
+	}
+	return string(merged), outcomeMerged, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"concept/pkg/git"
+	"concept/pkg/loader"
+	"concept/pkg/mdc"
+	"concept/pkg/providers"
+	"concept/pkg/rules"
+	"concept/pkg/selection"
+	"concept/pkg/verdict"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/rs/zerolog/log"
+)
+
+// usageEstimate is the estimated usage and cost of a set of requests
+type usageEstimate struct {
+	requests     int
+	inputTokens  int
+	outputTokens int
+	cost         float64
+}
+
+func (e *usageEstimate) add(other usageEstimate) {
+	e.requests += other.requests
+	e.inputTokens += other.inputTokens
+	e.outputTokens += other.outputTokens
+	e.cost += other.cost
+}
+
+// estimate reports the tokens and cost a review would use, per file, per rule
+// and in total, without calling a provider
+func estimate(args []string) {
+	var (
+		l string
+		r string
+
+		model       modelFlags
+		inputPrice  float64
+		outputPrice float64
+		editMode    string
+
+		selectedRules string
+		maxToolRounds int
+
+		selectRules    bool
+		selectModel    string
+		selectionCache string
+	)
+
+	fs := flag.NewFlagSet("estimate", flag.ExitOnError)
+	model.register(fs)
+	fs.StringVar(&l, "l", "warn", "set log level")
+	fs.StringVar(&r, "r", ".", "set the root directory")
+	fs.Float64Var(&inputPrice, "input-price", -1, "override the price in USD per million input tokens")
+	fs.Float64Var(&outputPrice, "output-price", -1, "override the price in USD per million output tokens")
+	fs.StringVar(&selectedRules, "rules", "", "comma-separated names of rules to apply to every file, including manual rules")
+	fs.StringVar(&editMode, "edit-mode", string(verdict.ModeRewrite), "how the model returns changes: rewrite for whole files, edits for search/replace edits")
+	fs.IntVar(&maxToolRounds, "max-tool-rounds", 5, "maximum rounds of tool calls per request (0 to disable tools)")
+	fs.BoolVar(&selectRules, "select-rules", true, "ask a model which agent requested rules apply to each file before reviewing it")
+	fs.StringVar(&selectModel, "select-model", os.Getenv("BAZ_SELECT_MODEL"), "set the model that selects agent requested rules (defaults to a small model of the first provider)")
+	fs.StringVar(&selectionCache, "selection-cache", selection.DefaultCacheFile, "file caching rule selections by file content (empty to disable)")
+	fs.Parse(args)
+
+	setupLogging(l)
+
+	mode, err := verdict.ParseMode(editMode)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid edit mode")
+	}
+
+	settings := providers.ModelSettings{Model: providers.DefaultModel(model.p)}.Merge(model.settings())
+
+	if selectModel == "" {
+		selectModel = providers.SmallModel(model.p)
+	}
+	selectSettings := settings.Merge(providers.ModelSettings{Model: selectModel})
+
+	// load all files in the working directory
+	files, err := loader.Load(r)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load files")
+	}
+
+	// load all rules
+	rulesInstance, err := loadRules(selectedRules)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load rules")
+	}
+
+	var (
+		total     usageEstimate
+		byFile    = map[string]usageEstimate{}
+		byRule    = map[string]usageEstimate{}
+		overflows = 0
+		unpriced  = map[string]bool{}
+	)
+
+	// Agent requested rules are chosen for each file by a selection request,
+	// unless the choice is cached. Which rules an uncached request chooses
+	// can't be known, so every candidate is counted as chosen.
+	candidates := rulesInstance.GetAgentRequestedRules()
+	var cache *selection.Cache
+	if selectRules && len(candidates) > 0 && selectionCache != "" {
+		cache, err = selection.LoadCache(selectionCache)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load rule selection cache")
+		}
+	}
+
+	// price returns what is known about a model with the price and context
+	// window flags applied
+	price := func(name string) providers.ModelInfo {
+		info, ok := providers.LookupModel(name)
+		if !ok {
+			unpriced[name] = true
+		}
+		if inputPrice >= 0 {
+			info.InputPrice = inputPrice
+		}
+		if outputPrice >= 0 {
+			info.OutputPrice = outputPrice
+		}
+		if model.contextWindow > 0 {
+			info.ContextWindow = model.contextWindow
+		}
+		return info
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "FILE\tMODEL\tREQUESTS\tINPUT TOKENS\tOUTPUT TOKENS\tCOST (USD)\t")
+
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			log.Error().Err(err).Str("file", file).Msg("Failed to read file")
+			continue
+		}
+
+		commit, _ := git.GetFileCommit(file)
+		stage, _ := git.GetFileStage(file)
+
+		matchingRules := rulesInstance.GetMatchingRules(file)
+
+		if selectRules && len(candidates) > 0 {
+			var (
+				cached []mdc.Mdc
+				ok     bool
+			)
+			if cache != nil {
+				cached, ok = cache.Lookup(file, content, selectSettings.Model, candidates)
+			}
+			if ok {
+				matchingRules = append(matchingRules, cached...)
+			} else {
+				info := price(selectSettings.Model)
+				names := make([]string, len(candidates))
+				for i, rule := range candidates {
+					names[i] = rules.Name(rule)
+				}
+				reply, _ := json.Marshal(map[string][]string{"rules": names})
+
+				usage := usageEstimate{
+					requests:     1,
+					inputTokens:  providers.EstimateTokens(selection.Messages(file, string(content), candidates)),
+					outputTokens: providers.EstimateTokens([]providers.ProviderMessage{{Content: string(reply)}}),
+				}
+				usage.cost = info.Cost(usage.inputTokens, usage.outputTokens)
+
+				fmt.Fprintf(out, "%s\t%s (rule selection)\t%d\t%d\t%d\t%.4f\t\n", file, selectSettings.Model, usage.requests, usage.inputTokens, usage.outputTokens, usage.cost)
+
+				fileUsage := byFile[file]
+				fileUsage.add(usage)
+				byFile[file] = fileUsage
+				total.add(usage)
+
+				matchingRules = append(matchingRules, candidates...)
+			}
+		}
+
+		groups := groupRulesBySettings(matchingRules)
+		if len(groups) == 0 {
+			groups = []ruleGroup{{}}
+		}
+
+		// The model rewrites the whole file, so each request is expected to
+		// produce about as many tokens as the file holds. Edits are usually
+		// much smaller, so this is an upper bound in edits mode.
+		outputTokens := providers.EstimateTokens([]providers.ProviderMessage{{Content: string(content)}})
+
+		for _, group := range groups {
+			groupSettings := settings.Merge(group.settings)
+
+			info := price(groupSettings.Model)
+
+			messages := buildMessages(0, file, commit, stage, string(content), group.rules, mode)
+
+			// Without a selection pass, agent requested rules are listed for
+			// the model to read with its tools
+			if !selectRules && maxToolRounds > 0 && len(candidates) > 0 {
+				last := len(messages) - 1
+				messages = append(messages[:last], requestableMessage(candidates), messages[last])
+			}
+			usage := usageEstimate{
+				requests:     1,
+				inputTokens:  providers.EstimateTokens(messages),
+				outputTokens: outputTokens,
+			}
+			if groupSettings.MaxTokens > 0 && int64(usage.outputTokens) > groupSettings.MaxTokens {
+				usage.outputTokens = int(groupSettings.MaxTokens)
+			}
+			usage.cost = info.Cost(usage.inputTokens, usage.outputTokens)
+
+			if usage.inputTokens+usage.outputTokens > info.ContextWindow {
+				overflows++
+				log.Warn().
+					Str("file", file).
+					Str("model", groupSettings.Model).
+					Int("tokens", usage.inputTokens+usage.outputTokens).
+					Int("context_window", info.ContextWindow).
+					Msg("Prompt exceeds the context window, rules would be summarised")
+			}
+
+			fmt.Fprintf(out, "%s\t%s\t%d\t%d\t%d\t%.4f\t\n", file, groupSettings.Model, usage.requests, usage.inputTokens, usage.outputTokens, usage.cost)
+
+			fileUsage := byFile[file]
+			fileUsage.add(usage)
+			byFile[file] = fileUsage
+			total.add(usage)
+
+			// Each rule is charged for the input tokens of its own message
+			for _, rule := range group.rules {
+				ruleTokens := providers.EstimateTokens([]providers.ProviderMessage{ruleMessage(rule)})
+
+				ruleUsage := byRule[rule.Path]
+				ruleUsage.add(usageEstimate{
+					requests:    1,
+					inputTokens: ruleTokens,
+					cost:        info.Cost(ruleTokens, 0),
+				})
+				byRule[rule.Path] = ruleUsage
+			}
+		}
+	}
+	out.Flush()
+
+	fmt.Println()
+	out = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "RULE\tFILES\tINPUT TOKENS\tCOST (USD)\t")
+
+	rulePaths := make([]string, 0, len(byRule))
+	for path := range byRule {
+		rulePaths = append(rulePaths, path)
+	}
+	sort.Strings(rulePaths)
+
+	for _, path := range rulePaths {
+		usage := byRule[path]
+		fmt.Fprintf(out, "%s\t%d\t%d\t%.4f\t\n", path, usage.requests, usage.inputTokens, usage.cost)
+	}
+	out.Flush()
+
+	fmt.Println()
+	out = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(out, "Files:\t%d\t\n", len(byFile))
+	fmt.Fprintf(out, "Requests:\t%d\t\n", total.requests)
+	fmt.Fprintf(out, "Input tokens:\t%d\t\n", total.inputTokens)
+	fmt.Fprintf(out, "Output tokens:\t%d\t\n", total.outputTokens)
+	fmt.Fprintf(out, "Estimated cost:\t$%.2f\t\n", total.cost)
+	out.Flush()
+
+	if overflows > 0 {
+		fmt.Printf("\n%d requests exceed the context window and would be summarised first.\n", overflows)
+	}
+	for model := range unpriced {
+		if inputPrice < 0 || outputPrice < 0 {
+			fmt.Printf("\nNo price known for %s; set -input-price and -output-price to include it.\n", model)
+		}
+	}
+}
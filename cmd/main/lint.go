@@ -0,0 +1,180 @@
+package main
+
+import (
+	"concept/pkg/loader"
+	"concept/pkg/mdc"
+	"concept/pkg/providers"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// defaultMaxRuleTokens is the largest rule body lint accepts without a
+// warning. Every matching rule is sent with each file, so large rules are
+// paid for many times over.
+const defaultMaxRuleTokens = 2000
+
+// lintProblem is a problem found with a rule file
+type lintProblem struct {
+	File string `json:"file"`
+	mdc.Problem
+}
+
+// rulesCommand runs the rules subcommands
+func rulesCommand(args []string) {
+	if len(args) == 0 || args[0] != "lint" {
+		fmt.Fprintln(os.Stderr, "usage: baz rules lint [flags]")
+		os.Exit(2)
+	}
+	lintRules(args[1:])
+}
+
+// lintRules checks every rule file and reports the problems found, exiting
+// non-zero if there are any errors
+func lintRules(args []string) {
+	var (
+		l         string
+		r         string
+		jsonOut   bool
+		strict    bool
+		maxTokens int
+	)
+
+	fs := flag.NewFlagSet("rules lint", flag.ExitOnError)
+	fs.StringVar(&l, "l", "warn", "set log level")
+	fs.StringVar(&r, "r", ".", "set the root directory")
+	fs.BoolVar(&jsonOut, "json", false, "print the problems as JSON")
+	fs.BoolVar(&strict, "strict", false, "exit non-zero on warnings as well as errors")
+	fs.IntVar(&maxTokens, "max-tokens", defaultMaxRuleTokens, "warn about rule bodies larger than this many tokens (0 for no limit)")
+	fs.Parse(args)
+
+	setupLogging(l)
+
+	ruleFiles, err := loader.LoadRules()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load rules")
+	}
+
+	files, err := loader.Load(r)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load files")
+	}
+
+	var (
+		problems []lintProblem
+		// The first rule with each description, to report duplicates
+		descriptions = map[string]lintProblem{}
+	)
+
+	report := func(path string, line int, severity mdc.Severity, message string) {
+		problems = append(problems, lintProblem{
+			File:    path,
+			Problem: mdc.Problem{Line: line, Severity: severity, Message: message},
+		})
+	}
+
+	for _, ruleFile := range ruleFiles {
+		path := filepath.Join(".cursor/rules", ruleFile)
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			report(path, 1, mdc.SeverityError, err.Error())
+			continue
+		}
+
+		// Globs are compiled one at a time, so that each bad one is reported
+		// and the rest of the rule is still checked
+		rule, globProblems, err := mdc.ParseAll(data)
+		if err != nil {
+			var parseErr *mdc.ParseError
+			if errors.As(err, &parseErr) {
+				report(path, parseErr.Line, mdc.SeverityError, parseErr.Err.Error())
+			} else {
+				report(path, 1, mdc.SeverityError, err.Error())
+			}
+			continue
+		}
+		rule.Path = path
+		for _, problem := range globProblems {
+			report(path, problem.Line, problem.Severity, problem.Message)
+		}
+
+		var validationErr *mdc.ValidationError
+		if err := rule.Validate(); errors.As(err, &validationErr) {
+			for _, problem := range validationErr.Problems {
+				report(path, problem.Line, problem.Severity, problem.Message)
+			}
+		}
+
+		for _, g := range rule.Globs {
+			if !matchesAny(g, files) {
+				report(path, rule.Line("globs"), mdc.SeverityWarning, fmt.Sprintf("glob '%s' matches no files", g.Pattern))
+			}
+		}
+
+		if rule.Description != "" {
+			key := strings.ToLower(strings.TrimSpace(rule.Description))
+			if first, ok := descriptions[key]; ok {
+				report(path, rule.Line("description"), mdc.SeverityError, fmt.Sprintf("description duplicates %s:%d", first.File, first.Line))
+			} else {
+				descriptions[key] = lintProblem{File: path, Problem: mdc.Problem{Line: rule.Line("description")}}
+			}
+		}
+
+		if maxTokens > 0 {
+			tokens := providers.EstimateTokens([]providers.ProviderMessage{{Content: rule.Content}})
+			if tokens > maxTokens {
+				report(path, rule.ContentLine(), mdc.SeverityWarning, fmt.Sprintf("rule body is ~%d tokens, more than %d", tokens, maxTokens))
+			}
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].File != problems[j].File {
+			return problems[i].File < problems[j].File
+		}
+		return problems[i].Line < problems[j].Line
+	})
+
+	counts := map[mdc.Severity]int{}
+	for _, problem := range problems {
+		counts[problem.Severity]++
+	}
+
+	if jsonOut {
+		if problems == nil {
+			problems = []lintProblem{}
+		}
+		data, err := json.MarshalIndent(problems, "", "  ")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to encode problems")
+		}
+		fmt.Println(string(data))
+	} else {
+		for _, problem := range problems {
+			fmt.Printf("%s:%d: %s: %s\n", problem.File, problem.Line, problem.Severity, problem.Message)
+		}
+		fmt.Printf("\n%d rules, %d errors, %d warnings\n", len(ruleFiles), counts[mdc.SeverityError], counts[mdc.SeverityWarning])
+	}
+
+	if counts[mdc.SeverityError] > 0 || (strict && counts[mdc.SeverityWarning] > 0) {
+		os.Exit(1)
+	}
+}
+
+// matchesAny reports whether a glob matches any of the files
+func matchesAny(g mdc.Glob, files []string) bool {
+	for _, file := range files {
+		if g.Match(file) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,15 +2,16 @@ package main
 
 import (
 	"concept/pkg/env"
-	"concept/pkg/git"
 	"concept/pkg/loader"
-	"concept/pkg/prompt"
+	"concept/pkg/patches"
 	"concept/pkg/providers"
 	"concept/pkg/rules"
-	"context"
+	"concept/pkg/selection"
+	"concept/pkg/tools"
+	"concept/pkg/verdict"
 	"flag"
+	"fmt"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
 
@@ -18,223 +19,215 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-// worker processes files using the provided provider
-func worker(id int, files <-chan string, client *providers.ProviderClient, rules *rules.Rules, wg *sync.WaitGroup) {
-	defer wg.Done()
-	for file := range files {
-		log.Info().
-			Int("worker_id", id).
-			Str("file", file).
-			Msg("Processing file")
-
-		messages := []providers.ProviderMessage{}
-
-		// get the file's current git commit
-		commit, err := git.GetFileCommit(file)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to get file commit")
-		}
-
-		log.Trace().Str("commit", commit).Msg("File commit")
-
-		messages = append(messages, providers.ProviderMessage{
-			Content: "Current commit: " + commit,
-			Role:    providers.ProviderMessageRoleUser,
-		})
-
-		// get the file's current git stage
-		stage, err := git.GetFileStage(file)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to get file stage")
-		}
-
-		log.Trace().Str("stage", stage).Msg("File stage")
-
-		messages = append(messages, providers.ProviderMessage{
-			Content: "Current stage: " + stage,
-			Role:    providers.ProviderMessageRoleUser,
-		})
-
-		// create the initial prompt
-		var initialPrompt []string = []string{
-			"# File Review",
-			"",
-			"You are an AI agent with expert knowledge in programming.",
-			"You'll be given some markdown component rules and a file to review.",
-			"",
-			"Expectations:",
-			"",
-			"- ALWAYS review the file against any rules provided.",
-			"- ALWAYS determine if there are any changes that need to be made.",
-			"- ALWAYS rewrite the entire file, including the changes.",
-			"- ALWAYS make changes that are required by the rules.",
-			"- NEVER code fence the output.",
-			"- NEVER make unnecessary changes.",
-			"- ALWAYS reply literally with 'x10Barry__Skipped' if there are no changes.",
-			"- ALWAYS reply literally with 'x10Barry__Error' if there is an error.",
-			"",
-			"Filename: " + file,
-			"",
-		}
-
-		// Create a new prompt instance
-		prompt := prompt.NewPrompt()
-		prompt.AppendString(strings.Join(initialPrompt, "\n"))
-
-		// Get matching rules for this file
-		matchingRules := rules.GetMatchingRules(file)
-		log.Debug().
-			Int("worker_id", id).
-			Str("file", file).
-			Int("matching_rules", len(matchingRules)).
-			Msg("Found matching rules")
-
-		prompt.AppendString("Rules:")
-
-		for _, rule := range matchingRules {
-			// append the rule content to the prompt
-			prompt.AppendString("- " + rule.Path + " (" + rule.Description + ")")
-
-			messages = append(messages, providers.ProviderMessage{
-				Content: "Rule: " + rule.Path + " (" + rule.Description + ")\n\n" + "```md\n" + rule.Content + "\n```",
-				Role:    providers.ProviderMessageRoleUser,
-			})
-
-			log.Debug().
-				Int("worker_id", id).
-				Str("file", file).
-				Str("rule", rule.Description).
-				Msg("Processing rule")
-
-			log.Trace().Str("rule_content", rule.Content).Msg("Rule content")
-		}
+// modelFlags are the model settings flags shared by every command that
+// talks to, or reasons about, a provider
+type modelFlags struct {
+	p               string
+	m               string
+	temperature     float64
+	maxTokens       int64
+	reasoningEffort string
+	contextWindow   int
+}
 
-		// Get the file's content
-		content, err := os.ReadFile(file)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to read file")
-			continue
-		}
+// register adds the model flags to a flag set
+func (f *modelFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.p, "p", "openai", "set the provider (openai, openai-compatible, local, anthropic, replay), or a comma-separated list to fall back through")
+	fs.StringVar(&f.m, "m", os.Getenv("BAZ_MODEL"), "set the default model")
+	fs.Float64Var(&f.temperature, "temperature", -1, "set the default sampling temperature (-1 for the provider default)")
+	fs.Int64Var(&f.maxTokens, "max-tokens", 0, "set the default maximum tokens to generate (0 for the provider default)")
+	fs.StringVar(&f.reasoningEffort, "reasoning-effort", os.Getenv("BAZ_REASONING_EFFORT"), "set the default reasoning effort (low, medium, high)")
+	fs.IntVar(&f.contextWindow, "context-window", 0, "override the model's context window in tokens (0 to use the known size)")
+}
 
-		log.Debug().Str("file", file).Str("content_length", strconv.Itoa(len(content))).Msg("File content")
-		log.Trace().Str("content", string(content)).Msg("File content")
+// settings returns the model settings chosen by the flags
+func (f *modelFlags) settings() providers.ModelSettings {
+	settings := providers.ModelSettings{
+		Model:           f.m,
+		MaxTokens:       f.maxTokens,
+		ReasoningEffort: f.reasoningEffort,
+	}
+	if f.temperature >= 0 {
+		temperature := f.temperature
+		settings.Temperature = &temperature
+	}
+	return settings
+}
 
-		fileToReview := providers.ProviderMessage{
-			Content: "File: " + file + "\n\n```\n" + string(content) + "\n```",
-			Role:    providers.ProviderMessageRoleUser,
-		}
-		messages = append(messages, fileToReview)
+// setupLogging sets the global log level and writes logs to stderr
+func setupLogging(l string) {
+	level, err := zerolog.ParseLevel(l)
+	if err != nil {
+		level = zerolog.InfoLevel
+	}
+	zerolog.SetGlobalLevel(level)
 
-		systemMessage := providers.ProviderMessage{
-			Content: prompt.GetAllAsString(),
-			Role:    providers.ProviderMessageRoleSystem,
-		}
-		messages = append([]providers.ProviderMessage{systemMessage}, messages...)
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+}
 
-		log.Debug().Int("num_messages", len(messages)).Msg("Messages")
-		log.Trace().Interface("messages", messages).Msg("Messages")
+// loadRules loads and parses every rule in .cursor/rules, selecting the
+// comma-separated rule names to apply to every file
+func loadRules(selected string) (*rules.Rules, error) {
+	ruleFiles, err := loader.LoadRules()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load rules: %w", err)
+	}
 
-		response, err := client.ChatCompletion(context.Background(), messages)
-		if err != nil {
-			log.Fatal().Str("file", file).Err(err).Msg("Failed to process file")
-		}
+	rulesInstance, err := rules.New(ruleFiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rules: %w", err)
+	}
 
-		result, err := providers.UnmapProviderMessage(client.ProviderName, response)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to unmap response")
-			continue
+	if selected != "" {
+		if err := rulesInstance.Select(strings.Split(selected, ",")); err != nil {
+			return nil, err
 		}
+	}
 
-		log.Trace().Interface("result", result).Msg("Result")
-
-		if result.Content == "x10Barry__Skipped" {
-			log.Info().
-				Int("worker_id", id).
-				Str("file", file).
-				Msg("Skipping file")
-			continue
-		}
+	return rulesInstance, nil
+}
 
-		if result.Content == "x10Barry__Error" {
-			log.Error().
-				Int("worker_id", id).
-				Str("file", file).
-				Msg("Error processing file")
+// unpricedModels returns the models, once each, that have no known price.
+// Empty model names are skipped.
+func unpricedModels(models []string) []string {
+	var (
+		unpriced []string
+		seen     = map[string]bool{}
+	)
+	for _, model := range models {
+		if model == "" || seen[model] {
 			continue
 		}
-
-		// create the patch directory if it doesn't exist
-		if _, err := os.Stat(".patches"); os.IsNotExist(err) {
-			os.Mkdir(".patches", 0755)
-			log.Info().Msg("Created .patches directory")
+		seen[model] = true
+		if _, ok := providers.LookupModel(model); !ok {
+			unpriced = append(unpriced, model)
 		}
+	}
+	return unpriced
+}
 
-		// write .patches/ to gitignore if it doesn't exist
-		if _, err := os.Stat(".gitignore"); os.IsNotExist(err) {
-			// read the gitignore file
-			gitignore, err := os.ReadFile(".gitignore")
-			if err != nil {
-				log.Error().Err(err).Msg("Failed to read gitignore")
-			}
-
-			// check if .patches/ is already in the gitignore file
-			if !strings.Contains(string(gitignore), ".patches/") {
-				os.WriteFile(".gitignore", []byte(".patches/\n"), 0644)
-				log.Info().Msg("Added .patches/ to gitignore")
-			}
-		}
+func main() {
+	// load environment variables
+	env.Load(".env")
 
-		// write the result to a file
-		os.WriteFile(".patches/"+file+".patch", []byte(result.Content), 0644)
-		log.Info().Str("file", file).Str("patch_file", ".patches/"+file+".patch").Msg("Wrote patch to file")
+	// The first argument may name a command; without one, files are reviewed
+	command, args := "review", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
 
-		log.Debug().
-			Int("worker_id", id).
-			Str("file", file).
-			Msg("Completed processing file")
+	switch command {
+	case "review":
+		review(args)
+	case "estimate":
+		estimate(args)
+	case "apply":
+		apply(args)
+	case "status":
+		status(args)
+	case "rules":
+		rulesCommand(args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", command)
+		fmt.Fprintln(os.Stderr, "usage: baz [review|estimate|apply|status|rules lint] [flags]")
+		os.Exit(2)
 	}
 }
 
-func main() {
+// review reviews every file against its matching rules and writes patches
+func review(args []string) {
 	var (
 		l string
 		T string
-		p string
 		r string
 		w int
-	)
 
-	flag.StringVar(&p, "p", "openai", "set the provider")
-	flag.StringVar(&l, "l", "info", "set log level")
-	flag.StringVar(&T, "T", "", "set the title of the project")
-	flag.StringVar(&r, "r", ".", "set the root directory")
-	flag.IntVar(&w, "w", 10, "number of workers")
-	flag.Parse()
+		model        modelFlags
+		maxAttempts  int
+		rpm          int
+		tpm          int
+		budgetTokens int64
+		budgetUSD    float64
+		inputPrice   float64
+		outputPrice  float64
 
-	level, err := zerolog.ParseLevel(l)
-	if err != nil {
-		level = zerolog.InfoLevel
+		providerBudgetTokens int64
+		providerBudgetUSD    float64
+
+		maxToolRounds int
+		editMode      string
+
+		maxContinuations int
+		selectedRules    string
+
+		selectRules    bool
+		selectModel    string
+		selectionCache string
+	)
+
+	fs := flag.NewFlagSet("review", flag.ExitOnError)
+	model.register(fs)
+	fs.StringVar(&l, "l", "info", "set log level")
+	fs.StringVar(&T, "T", "", "set the title of the project")
+	fs.StringVar(&r, "r", ".", "set the root directory")
+	fs.IntVar(&w, "w", 10, "number of workers")
+	fs.IntVar(&rpm, "rpm", 0, "maximum provider requests per minute (0 for no limit)")
+	fs.IntVar(&tpm, "tpm", 0, "maximum provider tokens per minute (0 for no limit)")
+	fs.IntVar(&maxAttempts, "max-attempts", providers.DefaultRetryPolicy.MaxAttempts, "maximum attempts per provider request")
+	fs.Int64Var(&budgetTokens, "budget-tokens", 0, "stop sending files once this many tokens are spent (0 for no limit)")
+	fs.Float64Var(&budgetUSD, "budget-usd", 0, "stop sending files once this many US dollars are spent (0 for no limit)")
+	fs.Float64Var(&inputPrice, "input-price", -1, "override the price in USD per million input tokens")
+	fs.Float64Var(&outputPrice, "output-price", -1, "override the price in USD per million output tokens")
+	fs.Int64Var(&providerBudgetTokens, "provider-budget-tokens", 0, "fall back to the next provider once one has spent this many tokens (0 for no limit)")
+	fs.Float64Var(&providerBudgetUSD, "provider-budget-usd", 0, "fall back to the next provider once one has spent this many US dollars (0 for no limit)")
+	fs.IntVar(&maxToolRounds, "max-tool-rounds", 5, "maximum rounds of tool calls per request (0 to disable tools)")
+	fs.StringVar(&editMode, "edit-mode", string(verdict.ModeRewrite), "how the model returns changes: rewrite for whole files, edits for search/replace edits")
+	fs.StringVar(&selectedRules, "rules", "", "comma-separated names of rules to apply to every file, including manual rules")
+	fs.BoolVar(&selectRules, "select-rules", true, "ask a model which agent requested rules apply to each file before reviewing it")
+	fs.StringVar(&selectModel, "select-model", os.Getenv("BAZ_SELECT_MODEL"), "set the model that selects agent requested rules (defaults to a small model of the first provider)")
+	fs.StringVar(&selectionCache, "selection-cache", selection.DefaultCacheFile, "file caching rule selections by file content (empty to disable)")
+	fs.IntVar(&maxContinuations, "max-continuations", 2, "maximum follow-up requests to continue a reply cut off at the output limit (0 to fail the file instead)")
+	fs.Parse(args)
+
+	setupLogging(l)
+
+	// Choosing rules is asked once per file, so it shouldn't cost as much as
+	// a review
+	if selectModel == "" {
+		selectModel = providers.SmallModel(model.p)
 	}
-	zerolog.SetGlobalLevel(level)
 
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	log.Info().
 		Str("title", T).
-		Str("provider", p).
+		Str("provider", model.p).
+		Str("model", model.m).
 		Str("log_level", l).
 		Int("workers", w).
 		Msg("Starting the project")
 
-	// load environment variables
-	env.Load(".env")
+	mode, err := verdict.ParseMode(editMode)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid edit mode")
+	}
 
 	// create a provider
-	provider, err := providers.NewClient(p)
+	provider, err := providers.NewClient(model.p, model.settings())
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to create provider")
 	}
 
-	log.Info().Str("provider", provider.ProviderName).Msg("Provider created")
+	provider.Retry.MaxAttempts = maxAttempts
+	provider.MaxContextTokens = model.contextWindow
+	provider.SetLimits(providers.Limits{
+		RequestsPerMinute: rpm,
+		TokensPerMinute:   tpm,
+		MaxConcurrency:    w,
+	})
+	provider.Budget = providers.NewBudget(budgetTokens, budgetUSD)
+	provider.SetProviderBudget(providerBudgetTokens, providerBudgetUSD)
+	provider.SetPrices(inputPrice, outputPrice)
+
+	log.Info().Str("provider", provider.ProviderName).Str("model", provider.Settings.Model).Msg("Provider created")
 
 	// load all files in the working directory
 	files, err := loader.Load(r)
@@ -245,34 +238,118 @@ func main() {
 	log.Info().Int("files", len(files)).Msg("Files loaded")
 
 	// load all rules
-	ruleFiles, err := loader.LoadRules()
+	rulesInstance, err := loadRules(selectedRules)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to load rules")
 	}
 
-	// Create Rules instance
-	rulesInstance, err := rules.New(ruleFiles)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to parse rules")
+	// A dollar budget can't count the spend of a model without a price
+	if (budgetUSD > 0 || providerBudgetUSD > 0) && (inputPrice < 0 || outputPrice < 0) {
+		models := append(provider.Models(), selectModel)
+		for _, rule := range rulesInstance.GetAllRules() {
+			models = append(models, rule.Model)
+		}
+		if unpriced := unpricedModels(models); len(unpriced) > 0 {
+			log.Fatal().
+				Strs("models", unpriced).
+				Msg("No price known for these models; set -input-price and -output-price to use a dollar budget")
+		}
+	}
+
+	// The model can read other files inside the root directory, except
+	// the ones the loader ignores
+	var fileTools *tools.Tools
+	if maxToolRounds > 0 {
+		ignorePatterns, err := loader.LoadIgnorePatterns(".bazignore")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load ignore patterns")
+		}
+		fileTools, err = tools.New(r, rulesInstance, ignorePatterns)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to create tools")
+		}
+	}
+
+	// Agent requested rules are chosen up front, reusing the decisions made
+	// for unchanged files
+	var (
+		selector *selection.Selector
+		cache    *selection.Cache
+	)
+	if selectRules && len(rulesInstance.GetAgentRequestedRules()) > 0 {
+		if selectionCache != "" {
+			cache, err = selection.LoadCache(selectionCache)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to load rule selection cache")
+			}
+		}
+		selector = selection.NewSelector(provider, providers.ModelSettings{Model: selectModel}, cache)
 	}
 
-	// Create a buffered channel to hold the files
-	filesChan := make(chan string, len(files))
+	// Files are handed to workers one at a time so that sending can stop as
+	// soon as the budget runs out
+	filesChan := make(chan string)
 	var wg sync.WaitGroup
+	report := &runReport{}
+	reviewerInstance := &reviewer{
+		client:           provider,
+		rules:            rulesInstance,
+		summaries:        &ruleSummaries{summaries: map[string]string{}},
+		report:           report,
+		tools:            fileTools,
+		maxToolRounds:    maxToolRounds,
+		mode:             mode,
+		maxContinuations: maxContinuations,
+		store:            patches.NewStore(patches.DefaultDir),
+		selector:         selector,
+	}
 
 	// Start worker goroutines
 	for i := 1; i <= w; i++ {
 		wg.Add(1)
-		go worker(i, filesChan, provider, rulesInstance, &wg)
+		go worker(i, filesChan, reviewerInstance, &wg)
 	}
 
 	// Send files to the workers
-	for _, file := range files {
+	for i, file := range files {
+		if provider.Budget.Exhausted() {
+			report.skip(files[i:]...)
+			log.Warn().Int("remaining", len(files)-i).Msg("Budget exhausted, not sending remaining files")
+			break
+		}
 		filesChan <- file
 	}
 	close(filesChan) // Close channel to signal no more files
 
 	// Wait for all workers to finish
 	wg.Wait()
+
+	if err := reviewerInstance.store.WriteIndex(); err != nil {
+		log.Error().Err(err).Msg("Failed to write patch index")
+	}
+
+	if cache != nil {
+		if err := cache.Save(); err != nil {
+			log.Error().Err(err).Msg("Failed to save rule selection cache")
+		}
+	}
+
+	tokens, cost := provider.Budget.Spent()
+	log.Info().Int64("tokens", tokens).Float64("cost_usd", cost).Msg("Spend")
+
+	if len(report.skipped) > 0 {
+		log.Warn().
+			Int("skipped", len(report.skipped)).
+			Strs("files", report.skipped).
+			Msg("Some files were skipped because the budget ran out")
+	}
+
+	if len(report.failed) > 0 {
+		log.Warn().
+			Int("failed", len(report.failed)).
+			Strs("files", report.failed).
+			Msg("Some files could not be processed")
+	}
+
 	log.Info().Msg("All files processed")
 }
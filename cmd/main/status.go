@@ -0,0 +1,169 @@
+package main
+
+import (
+	"concept/pkg/diff"
+	"concept/pkg/git"
+	"concept/pkg/patches"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/rs/zerolog/log"
+)
+
+// patchStatus is how a patch relates to the current state of its file
+type patchStatus string
+
+const (
+	// The file is as it was reviewed, so the patch applies cleanly
+	statusApplicable patchStatus = "applicable"
+	// The file has changed since the review, but the patch still merges
+	statusStale patchStatus = "stale"
+	// The file already has the patch's changes
+	statusApplied patchStatus = "applied"
+	// The file has changed in ways that conflict with the patch
+	statusConflicting patchStatus = "conflicting"
+	// The file is no longer in the repository
+	statusOrphaned patchStatus = "orphaned"
+	// The file has changed since the review and the reviewed content is no
+	// longer in the repository, so the patch can't be checked
+	statusMissingBase patchStatus = "missing-base"
+)
+
+// patchState is the status of one patch
+type patchState struct {
+	File   string      `json:"file"`
+	Patch  string      `json:"patch"`
+	Status patchStatus `json:"status"`
+	// The blob the patch was made against, and the blob in the git index now
+	BaseBlob    string `json:"base_blob"`
+	CurrentBlob string `json:"current_blob,omitempty"`
+}
+
+// status reports whether each patch in the index still applies to its file
+func status(args []string) {
+	var (
+		l        string
+		jsonOut  bool
+		statuses []patchState
+	)
+
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	fs.StringVar(&l, "l", "warn", "set log level")
+	fs.BoolVar(&jsonOut, "json", false, "print the statuses as JSON")
+	fs.Parse(args)
+
+	setupLogging(l)
+
+	store := patches.NewStore(patches.DefaultDir)
+	index, err := store.ReadIndex()
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Fatal().Msg("No patch index found, run a review first")
+		}
+		log.Fatal().Err(err).Msg("Failed to read patch index")
+	}
+
+	counts := map[patchStatus]int{}
+	for _, meta := range index.Patches {
+		state, err := classifyPatch(store, meta)
+		if err != nil {
+			log.Error().Err(err).Str("file", meta.File).Msg("Failed to check patch")
+			continue
+		}
+		statuses = append(statuses, state)
+		counts[state.Status]++
+	}
+
+	if jsonOut {
+		if statuses == nil {
+			statuses = []patchState{}
+		}
+		data, err := json.MarshalIndent(statuses, "", "  ")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to encode statuses")
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "STATUS\tFILE\tPATCH\t")
+	for _, state := range statuses {
+		fmt.Fprintf(out, "%s\t%s\t%s\t\n", state.Status, state.File, state.Patch)
+	}
+	out.Flush()
+
+	fmt.Printf("\n%d applicable, %d stale, %d applied, %d conflicting, %d orphaned, %d missing base\n",
+		counts[statusApplicable], counts[statusStale], counts[statusApplied], counts[statusConflicting], counts[statusOrphaned], counts[statusMissingBase])
+}
+
+// classifyPatch compares the blob a patch was made against with the file's
+// blob in the git index, or with the file itself if it was never added to git
+func classifyPatch(store *patches.Store, meta patches.Metadata) (patchState, error) {
+	state := patchState{
+		File:     meta.File,
+		Patch:    meta.Patch,
+		BaseBlob: meta.BaseBlob,
+	}
+
+	content, err := os.ReadFile(meta.File)
+	if os.IsNotExist(err) {
+		state.Status = statusOrphaned
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	blob, err := git.GetFileBlob(meta.File)
+	if err != nil {
+		return state, err
+	}
+	if blob == "" {
+		blob = git.HashBlob(content)
+	}
+	state.CurrentBlob = blob
+
+	if blob == meta.BaseBlob {
+		state.Status = statusApplicable
+		return state, nil
+	}
+
+	// The base has moved; check whether the patch still merges into it
+	patch, err := store.Read(meta.File)
+	if err != nil {
+		return state, err
+	}
+	header, hunks, err := diff.Parse(patch)
+	if err != nil {
+		return state, err
+	}
+	current := content
+	if blob != git.HashBlob(content) {
+		if current, err = git.ReadBlob(blob); err != nil {
+			return state, err
+		}
+	}
+
+	_, outcome, err := mergePatch(header, hunks, current)
+	switch {
+	case errors.Is(err, errConflict):
+		state.Status = statusConflicting
+	case errors.Is(err, errMissingBase):
+		state.Status = statusMissingBase
+	case err != nil:
+		return state, err
+	case outcome == outcomeAlreadyApplied:
+		state.Status = statusApplied
+	case outcome == outcomeApplied:
+		state.Status = statusApplicable
+	default:
+		state.Status = statusStale
+	}
+
+	return state, nil
+}
@@ -0,0 +1,655 @@
+package main
+
+import (
+	"concept/pkg/diff"
+	"concept/pkg/edit"
+	"concept/pkg/git"
+	"concept/pkg/mdc"
+	"concept/pkg/patches"
+	"concept/pkg/prompt"
+	"concept/pkg/providers"
+	"concept/pkg/rules"
+	"concept/pkg/selection"
+	"concept/pkg/tools"
+	"concept/pkg/verdict"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// runReport records the files that could not be processed during a run
+type runReport struct {
+	mu     sync.Mutex
+	failed []string
+	// Files not reviewed because the budget ran out
+	skipped []string
+}
+
+// skip records files as skipped
+func (r *runReport) skip(files ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.skipped = append(r.skipped, files...)
+}
+
+// fail records a file as failed
+func (r *runReport) fail(file string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed = append(r.failed, file)
+}
+
+// reviewer holds what the workers of a run share
+type reviewer struct {
+	client    *providers.ProviderClient
+	rules     *rules.Rules
+	summaries *ruleSummaries
+	report    *runReport
+	// The tools offered to the model, nil when tools are disabled
+	tools *tools.Tools
+	// The most rounds of tool calls the model can make per request
+	maxToolRounds int
+	// Whether the model rewrites whole files or returns edits
+	mode verdict.Mode
+	// The most follow-up requests made to continue a reply that was cut
+	// off at the output limit
+	maxContinuations int
+	// Where patches are written
+	store *patches.Store
+	// Chooses the agent requested rules for each file, nil to leave them
+	// to the model's tools
+	selector *selection.Selector
+}
+
+// toolRoundsExhausted asks the model to finish once it has used all of its
+// rounds of tool calls
+const toolRoundsExhausted = "You have used all of your tool calls. Reply now with the review, without calling any more tools."
+
+// complete sends a request to the model, running the tools it calls and
+// sending back their results until it replies or runs out of tool rounds.
+// Replies cut off at the output limit are continued. The completion's usage
+// covers every request made.
+func (r *reviewer) complete(ctx context.Context, id int, file string, request providers.Request) (providers.Completion, error) {
+	if r.tools != nil && r.maxToolRounds > 0 {
+		request.Tools = r.tools.Definitions()
+	}
+
+	var usage providers.Usage
+	for round := 0; ; round++ {
+		completion, err := r.client.ChatCompletion(ctx, request)
+		if err != nil {
+			return completion, err
+		}
+		usage.Add(completion.Usage)
+		completion.Usage = usage
+
+		if completion.FinishReason == providers.FinishReasonLength {
+			return r.continueTruncated(ctx, id, file, request, completion)
+		}
+
+		if len(completion.Message.ToolCalls) == 0 {
+			return completion, nil
+		}
+
+		if request.Tools == nil || round >= r.maxToolRounds {
+			return completion, errors.New("model kept calling tools after running out of tool rounds")
+		}
+
+		log.Debug().
+			Int("worker_id", id).
+			Str("file", file).
+			Int("round", round+1).
+			Int("tool_calls", len(completion.Message.ToolCalls)).
+			Msg("Running tool calls")
+
+		request.Messages = append(request.Messages, completion.Message)
+		for _, call := range completion.Message.ToolCalls {
+			request.Messages = append(request.Messages, providers.ProviderMessage{
+				Content:    r.tools.Call(call),
+				Role:       providers.ProviderMessageRoleTool,
+				ToolCallID: call.ID,
+			})
+		}
+
+		// The tools stay defined so that providers accept the earlier calls
+		// in the conversation, but the model is told to stop using them
+		if round+1 == r.maxToolRounds {
+			request.Messages = append(request.Messages, providers.ProviderMessage{
+				Content: toolRoundsExhausted,
+				Role:    providers.ProviderMessageRoleUser,
+			})
+		}
+	}
+}
+
+// continueReply asks the model to carry on from where its reply was cut off
+const continueReply = "Your reply was cut off. Continue it exactly from where it stopped, without repeating anything or adding any other text."
+
+// continueTruncated asks the model to continue a reply that stopped at the
+// output limit and stitches the parts together. A reply still cut off after
+// the last continuation is an error, so that a partial file is never used.
+func (r *reviewer) continueTruncated(ctx context.Context, id int, file string, request providers.Request, completion providers.Completion) (providers.Completion, error) {
+	content := completion.Message.Content
+	usage := completion.Usage
+
+	// The continuation is only a fragment of the structured reply
+	request.ResponseFormat = nil
+
+	for n := 1; completion.FinishReason == providers.FinishReasonLength; n++ {
+		if len(completion.Message.ToolCalls) > 0 {
+			return completion, errors.New("tool call was cut off at the output limit")
+		}
+		if n > r.maxContinuations {
+			return completion, fmt.Errorf("reply was cut off at the output limit after %d continuations", r.maxContinuations)
+		}
+
+		log.Info().
+			Int("worker_id", id).
+			Str("file", file).
+			Int("continuation", n).
+			Int("length", len(content)).
+			Msg("Reply cut off at the output limit, continuing")
+
+		request.Messages = append(request.Messages,
+			providers.ProviderMessage{
+				Content: completion.Message.Content,
+				Role:    providers.ProviderMessageRoleAssistant,
+			},
+			providers.ProviderMessage{
+				Content: continueReply,
+				Role:    providers.ProviderMessageRoleUser,
+			},
+		)
+
+		var err error
+		completion, err = r.client.ChatCompletion(ctx, request)
+		if err != nil {
+			return completion, err
+		}
+		content += completion.Message.Content
+		usage.Add(completion.Usage)
+	}
+
+	completion.Message.Content = content
+	completion.Usage = usage
+	return completion, nil
+}
+
+// defaultOutputReserve is the room left in the context window for the
+// response when no maximum tokens are set
+const defaultOutputReserve = 4096
+
+// ruleSummaries caches rule summaries for the run, by rule path and model
+type ruleSummaries struct {
+	mu        sync.Mutex
+	summaries map[string]string
+}
+
+// summarise returns a summary of the rule's content written by the model
+// chosen by settings
+func (s *ruleSummaries) summarise(ctx context.Context, client *providers.ProviderClient, rule mdc.Mdc, settings providers.ModelSettings) (string, error) {
+	key := rule.Path + "|" + client.Settings.Merge(settings).Model
+
+	s.mu.Lock()
+	summary, ok := s.summaries[key]
+	s.mu.Unlock()
+	if ok {
+		return summary, nil
+	}
+
+	completion, err := client.SummariseMessages(ctx, providers.Request{
+		Messages: []providers.ProviderMessage{ruleMessage(rule)},
+		Settings: settings,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	s.summaries[key] = completion.Message.Content
+	s.mu.Unlock()
+
+	return completion.Message.Content, nil
+}
+
+// fitContextWindow builds the messages for a rule group, summarising rules
+// from the lowest priority (the last matched) up until the messages fit in
+// the model's context window
+func fitContextWindow(ctx context.Context, id int, client *providers.ProviderClient, summaries *ruleSummaries, file string, commit string, stage string, content string, group ruleGroup, mode verdict.Mode) ([]providers.ProviderMessage, error) {
+	reserve := int(client.Settings.Merge(group.settings).MaxTokens)
+	if reserve <= 0 {
+		reserve = defaultOutputReserve
+	}
+	budget := client.ContextWindow(group.settings) - reserve
+
+	rules := append([]mdc.Mdc(nil), group.rules...)
+	for i := len(rules) - 1; ; i-- {
+		messages := buildMessages(id, file, commit, stage, content, rules, mode)
+
+		tokens := providers.EstimateTokens(messages)
+		if tokens <= budget {
+			return messages, nil
+		}
+
+		if i < 0 {
+			return nil, fmt.Errorf("prompt needs ~%d tokens but only %d fit in the context window", tokens, budget)
+		}
+
+		log.Info().
+			Int("worker_id", id).
+			Str("file", file).
+			Str("rule", rules[i].Path).
+			Int("tokens", tokens).
+			Int("budget", budget).
+			Msg("Prompt too large, summarising rule")
+
+		summary, err := summaries.summarise(ctx, client, rules[i], group.settings)
+		if err != nil {
+			return nil, fmt.Errorf("failed to summarise rule %s: %w", rules[i].Path, err)
+		}
+		rules[i].Content = summary
+	}
+}
+
+// ruleMessage returns the message presenting a rule to the model
+func ruleMessage(rule mdc.Mdc) providers.ProviderMessage {
+	return providers.ProviderMessage{
+		Content: "Rule: " + rule.Path + " (" + rule.Description + ")\n\n" + "```md\n" + rule.Content + "\n```",
+		Role:    providers.ProviderMessageRoleUser,
+	}
+}
+
+// requestableMessage lists the agent requested rules, which the model can
+// read with the get_rule tool when they are relevant to the file
+func requestableMessage(rules []mdc.Mdc) providers.ProviderMessage {
+	lines := []string{"These rules apply only when relevant to the file. If one is, read it with the get_rule tool and apply it:", ""}
+	for _, rule := range rules {
+		lines = append(lines, "- "+rule.Path+" ("+rule.Description+")")
+	}
+
+	return providers.ProviderMessage{
+		Content: strings.Join(lines, "\n"),
+		Role:    providers.ProviderMessageRoleUser,
+	}
+}
+
+// ruleGroup is a set of matching rules that share the same model settings
+type ruleGroup struct {
+	settings providers.ModelSettings
+	rules    []mdc.Mdc
+}
+
+// ruleSettings returns the model settings declared in a rule's frontmatter
+func ruleSettings(rule mdc.Mdc) providers.ModelSettings {
+	return providers.ModelSettings{
+		Model:           rule.Model,
+		Temperature:     rule.Temperature,
+		MaxTokens:       rule.MaxTokens,
+		ReasoningEffort: rule.ReasoningEffort,
+	}
+}
+
+// groupRulesBySettings groups rules by their model settings, keeping the order
+// in which each combination of settings first appears
+func groupRulesBySettings(matchingRules []mdc.Mdc) []ruleGroup {
+	groups := []ruleGroup{}
+	index := map[string]int{}
+
+	for _, rule := range matchingRules {
+		settings := ruleSettings(rule)
+
+		temperature := ""
+		if settings.Temperature != nil {
+			temperature = strconv.FormatFloat(*settings.Temperature, 'f', -1, 64)
+		}
+		key := strings.Join([]string{settings.Model, temperature, strconv.FormatInt(settings.MaxTokens, 10), settings.ReasoningEffort}, "|")
+
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, ruleGroup{settings: settings})
+		}
+		groups[i].rules = append(groups[i].rules, rule)
+	}
+
+	return groups
+}
+
+// buildMessages assembles the messages asking the model to review content
+// against a group of rules
+func buildMessages(id int, file string, commit string, stage string, content string, rules []mdc.Mdc, mode verdict.Mode) []providers.ProviderMessage {
+	messages := []providers.ProviderMessage{}
+
+	messages = append(messages, providers.ProviderMessage{
+		Content: "Current commit: " + commit,
+		Role:    providers.ProviderMessageRoleUser,
+	})
+
+	messages = append(messages, providers.ProviderMessage{
+		Content: "Current stage: " + stage,
+		Role:    providers.ProviderMessageRoleUser,
+	})
+
+	// create the initial prompt
+	var initialPrompt []string = []string{
+		"# File Review",
+		"",
+		"You are an AI agent with expert knowledge in programming.",
+		"You'll be given some markdown component rules and a file to review.",
+		"",
+		"Expectations:",
+		"",
+		"- ALWAYS review the file against any rules provided.",
+		"- ALWAYS determine if there are any changes that need to be made.",
+		"- ALWAYS make changes that are required by the rules.",
+		"- NEVER make unnecessary changes.",
+		"",
+	}
+	initialPrompt = append(initialPrompt, verdict.Instructions(mode)...)
+	initialPrompt = append(initialPrompt,
+		"",
+		"Filename: "+file,
+		"",
+	)
+
+	// Create a new prompt instance
+	prompt := prompt.NewPrompt()
+	prompt.AppendString(strings.Join(initialPrompt, "\n"))
+
+	prompt.AppendString("Rules:")
+
+	for _, rule := range rules {
+		// append the rule content to the prompt
+		prompt.AppendString("- " + rule.Path + " (" + rule.Description + ")")
+
+		messages = append(messages, ruleMessage(rule))
+
+		log.Debug().
+			Int("worker_id", id).
+			Str("file", file).
+			Str("rule", rule.Description).
+			Strs("globs", rule.Patterns()).
+			Msg("Processing rule")
+
+		log.Trace().Str("rule_content", rule.Content).Msg("Rule content")
+	}
+
+	// Line range edits need the line numbers
+	shown := content
+	if mode == verdict.ModeEdits {
+		shown = edit.NumberLines(content)
+	}
+
+	fileToReview := providers.ProviderMessage{
+		Content: "File: " + file + "\n\n```\n" + shown + "\n```",
+		Role:    providers.ProviderMessageRoleUser,
+	}
+	messages = append(messages, fileToReview)
+
+	systemMessage := providers.ProviderMessage{
+		Content: prompt.GetAllAsString(),
+		Role:    providers.ProviderMessageRoleSystem,
+	}
+	messages = append([]providers.ProviderMessage{systemMessage}, messages...)
+
+	return messages
+}
+
+// discardPatch removes the patch an earlier run wrote for a file, so that
+// apply doesn't bring back changes this run's review didn't make
+func (r *reviewer) discardPatch(file string) {
+	if err := r.store.Remove(file); err != nil {
+		log.Warn().Str("file", file).Err(err).Msg("Failed to remove the earlier patch")
+	}
+}
+
+// worker processes files using the provided provider
+func worker(id int, files <-chan string, r *reviewer, wg *sync.WaitGroup) {
+	defer wg.Done()
+	client, rules, summaries, report := r.client, r.rules, r.summaries, r.report
+	for file := range files {
+		// The budget may have run out while the file waited to be received
+		if client.Budget.Exhausted() {
+			report.skip(file)
+			continue
+		}
+
+		log.Info().
+			Int("worker_id", id).
+			Str("file", file).
+			Msg("Processing file")
+
+		// get the file's current git commit
+		commit, err := git.GetFileCommit(file)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to get file commit")
+		}
+
+		log.Trace().Str("commit", commit).Msg("File commit")
+
+		// get the file's current git stage
+		stage, err := git.GetFileStage(file)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to get file stage")
+		}
+
+		log.Trace().Str("stage", stage).Msg("File stage")
+
+		// Get the file's content
+		content, err := os.ReadFile(file)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to read file")
+			r.discardPatch(file)
+			continue
+		}
+
+		// Get matching rules for this file
+		matchingRules := rules.GetMatchingRules(file)
+
+		// Agent requested rules chosen for the file join the matching rules
+		var selectionUsage providers.Usage
+		if r.selector != nil {
+			selected, usage, err := r.selector.Select(context.Background(), file, content, rules.GetAgentRequestedRules())
+			if err != nil {
+				log.Warn().Str("file", file).Err(err).Msg("Failed to select agent requested rules")
+			}
+			for _, rule := range selected {
+				log.Debug().
+					Int("worker_id", id).
+					Str("file", file).
+					Str("rule", rule.Path).
+					Msg("Selected agent requested rule")
+			}
+			matchingRules = append(matchingRules, selected...)
+			selectionUsage = usage
+		}
+
+		log.Debug().
+			Int("worker_id", id).
+			Str("file", file).
+			Int("matching_rules", len(matchingRules)).
+			Msg("Found matching rules")
+
+		log.Debug().Str("file", file).Str("content_length", strconv.Itoa(len(content))).Msg("File content")
+		log.Trace().Str("content", string(content)).Msg("File content")
+
+		// Rules with different model settings are reviewed in separate calls,
+		// each one reviewing the output of the last
+		groups := groupRulesBySettings(matchingRules)
+		if len(groups) == 0 {
+			groups = []ruleGroup{{}}
+		}
+
+		reviewed := string(content)
+		changed := false
+		failed := false
+		meta := patches.Metadata{
+			File:       file,
+			BaseCommit: strings.TrimSpace(commit),
+			BaseBlob:   git.HashBlob(content),
+			Stage:      strings.TrimSpace(stage),
+			Usage:      selectionUsage,
+		}
+
+		for _, group := range groups {
+			messages, err := fitContextWindow(context.Background(), id, client, summaries, file, commit, stage, reviewed, group, r.mode)
+			if err != nil {
+				log.Error().Str("file", file).Err(err).Msg("Failed to fit prompt in context window")
+				failed = true
+				break
+			}
+
+			// Without a selection pass, the model can only read agent
+			// requested rules through its tools
+			if requestable := rules.GetAgentRequestedRules(); r.selector == nil && r.tools != nil && r.maxToolRounds > 0 && len(requestable) > 0 {
+				last := len(messages) - 1
+				messages = append(messages[:last], requestableMessage(requestable), messages[last])
+			}
+
+			log.Debug().
+				Int("num_messages", len(messages)).
+				Str("model", client.Settings.Merge(group.settings).Model).
+				Msg("Messages")
+			log.Trace().Interface("messages", messages).Msg("Messages")
+
+			completion, err := r.complete(context.Background(), id, file, providers.Request{
+				Messages:       messages,
+				Settings:       group.settings,
+				ResponseFormat: verdict.ResponseFormat(r.mode),
+			})
+			if err != nil {
+				log.Error().Str("file", file).Err(err).Msg("Failed to process file")
+				failed = true
+				break
+			}
+
+			// Every reply is paid for, whatever the review says
+			meta.Usage.Add(completion.Usage)
+
+			result := completion.Message
+
+			log.Trace().Interface("result", result).Str("provider", completion.Provider).Msg("Result")
+
+			review, err := verdict.Parse(result.Content)
+			if err != nil {
+				log.Error().Str("file", file).Err(err).Msg("Failed to read review")
+				failed = true
+				break
+			}
+
+			for _, violation := range review.Violations {
+				log.Debug().
+					Int("worker_id", id).
+					Str("file", file).
+					Str("rule", violation.Rule).
+					Bool("fixed", violation.Fixed).
+					Msg(violation.Description)
+			}
+
+			if review.Status == verdict.StatusUnchanged {
+				log.Debug().
+					Int("worker_id", id).
+					Str("file", file).
+					Int("rules", len(group.rules)).
+					Str("rationale", review.Rationale).
+					Msg("No changes for rule group")
+				continue
+			}
+
+			if review.Status == verdict.StatusError {
+				log.Error().
+					Int("worker_id", id).
+					Str("file", file).
+					Str("rationale", review.Rationale).
+					Msg("Error processing file")
+				failed = true
+				break
+			}
+
+			reviewed, err = review.Apply(reviewed)
+			if err != nil {
+				log.Error().Str("file", file).Err(err).Msg("Failed to apply edits")
+				failed = true
+				break
+			}
+			changed = true
+
+			meta.Changes = append(meta.Changes, patches.Change{
+				Provider:   completion.Provider,
+				Model:      completion.Model,
+				Rules:      patches.Rules(group.rules),
+				Usage:      completion.Usage,
+				PromptHash: patches.PromptHash(messages),
+				Violations: review.Violations,
+				Rationale:  review.Rationale,
+			})
+		}
+
+		if failed {
+			report.fail(file)
+			r.discardPatch(file)
+			continue
+		}
+
+		if !changed || reviewed == string(content) {
+			log.Info().
+				Int("worker_id", id).
+				Str("file", file).
+				Msg("Skipping file")
+			r.discardPatch(file)
+			continue
+		}
+
+		// write .patches/ to gitignore if it doesn't exist
+		if _, err := os.Stat(".gitignore"); os.IsNotExist(err) {
+			// read the gitignore file
+			gitignore, err := os.ReadFile(".gitignore")
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to read gitignore")
+			}
+
+			// check if .patches/ is already in the gitignore file
+			if !strings.Contains(string(gitignore), ".patches/") {
+				os.WriteFile(".gitignore", []byte(".patches/\n"), 0644)
+				log.Info().Msg("Added .patches/ to gitignore")
+			}
+		}
+
+		// Keep the reviewed content in git, so that apply can merge the
+		// patch into the file once it has changed
+		if _, err := git.WriteBlob(content); err != nil {
+			log.Warn().Str("file", file).Err(err).Msg("Failed to store the reviewed content, the patch will only apply to the unchanged file")
+		}
+
+		// write the changes as a diff against the reviewed content, with
+		// the patch's metadata alongside it
+		meta.PatchBlob = git.HashBlob([]byte(reviewed))
+		meta.CreatedAt = time.Now().UTC()
+		patch := diff.Patch(diff.Header{
+			File:       file,
+			BaseCommit: meta.BaseCommit,
+			OldBlob:    meta.BaseBlob,
+			NewBlob:    meta.PatchBlob,
+		}, string(content), reviewed)
+		if err := r.store.Write(file, patch, &meta); err != nil {
+			log.Error().Str("file", file).Err(err).Msg("Failed to write patch")
+			report.fail(file)
+			r.discardPatch(file)
+			continue
+		}
+		log.Info().Str("file", file).Str("patch_file", meta.Patch).Msg("Wrote patch to file")
+
+		log.Debug().
+			Int("worker_id", id).
+			Str("file", file).
+			Msg("Completed processing file")
+	}
+}
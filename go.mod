@@ -4,13 +4,14 @@ go 1.21
 
 require (
 	github.com/gabriel-vasile/mimetype v1.4.8
+	github.com/gobwas/glob v0.2.3
 	github.com/openai/openai-go v0.1.0-alpha.62
 	github.com/rs/zerolog v1.33.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/BurntSushi/toml v1.5.0 // indirect
-	github.com/gobwas/glob v0.2.3 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
 	github.com/tidwall/gjson v1.18.0 // indirect
@@ -19,5 +20,4 @@ require (
 	github.com/tidwall/sjson v1.2.5 // indirect
 	golang.org/x/net v0.33.0 // indirect
 	golang.org/x/sys v0.28.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,161 @@
+package diff
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Hunk is a change to one run of lines
+type Hunk struct {
+	OldStart int
+	OldCount int
+	NewStart int
+	NewCount int
+	// Each line of the hunk with its ' ', '-' or '+' prefix and terminator
+	Lines []string
+}
+
+// Parse reads the header and hunks of a patch written by Patch
+func Parse(patch string) (Header, []Hunk, error) {
+	var (
+		header Header
+		hunks  []Hunk
+		// The old and new lines still to read in the current hunk
+		oldLeft, newLeft int
+	)
+
+	for _, text := range splitLines(patch) {
+		content := strings.TrimSuffix(text, "\n")
+
+		if strings.HasPrefix(text, `\`) && len(hunks) > 0 && len(hunks[len(hunks)-1].Lines) > 0 {
+			// The previous line has no terminator
+			lines := hunks[len(hunks)-1].Lines
+			lines[len(lines)-1] = strings.TrimSuffix(lines[len(lines)-1], "\n")
+			continue
+		}
+
+		if oldLeft > 0 || newLeft > 0 {
+			switch {
+			case strings.HasPrefix(text, " ") && oldLeft > 0 && newLeft > 0:
+				oldLeft--
+				newLeft--
+			case strings.HasPrefix(text, "-") && oldLeft > 0:
+				oldLeft--
+			case strings.HasPrefix(text, "+") && newLeft > 0:
+				newLeft--
+			default:
+				return header, nil, fmt.Errorf("diff: unexpected line in hunk %d: %q", len(hunks), content)
+			}
+			hunks[len(hunks)-1].Lines = append(hunks[len(hunks)-1].Lines, text)
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(content, "base-commit: "):
+			header.BaseCommit = strings.TrimPrefix(content, "base-commit: ")
+		case strings.HasPrefix(content, "index "):
+			blobs, _, _ := strings.Cut(strings.TrimPrefix(content, "index "), " ")
+			if old, new, ok := strings.Cut(blobs, ".."); ok {
+				header.OldBlob, header.NewBlob = old, new
+			}
+		case strings.HasPrefix(content, "+++ "):
+			header.File = strings.TrimPrefix(strings.TrimPrefix(content, "+++ "), "b/")
+		case strings.HasPrefix(content, "@@ "):
+			var hunk Hunk
+			if err := parseHunkHeader(content, &hunk); err != nil {
+				return header, nil, err
+			}
+			hunks = append(hunks, hunk)
+			oldLeft, newLeft = hunk.OldCount, hunk.NewCount
+		}
+	}
+
+	if oldLeft > 0 || newLeft > 0 {
+		return header, nil, fmt.Errorf("diff: hunk %d is incomplete", len(hunks))
+	}
+	if header.File == "" {
+		return header, nil, errors.New("diff: patch names no file")
+	}
+
+	return header, hunks, nil
+}
+
+// parseHunkHeader reads the line ranges from a hunk's @@ line
+func parseHunkHeader(text string, hunk *Hunk) error {
+	fields := strings.Fields(text)
+	if len(fields) < 4 || !strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+		return fmt.Errorf("diff: invalid hunk header %q", text)
+	}
+
+	var err error
+	if hunk.OldStart, hunk.OldCount, err = parseRange(fields[1][1:]); err != nil {
+		return fmt.Errorf("diff: invalid hunk header %q: %w", text, err)
+	}
+	if hunk.NewStart, hunk.NewCount, err = parseRange(fields[2][1:]); err != nil {
+		return fmt.Errorf("diff: invalid hunk header %q: %w", text, err)
+	}
+	return nil
+}
+
+// parseRange reads a start,count range, where the count defaults to 1
+func parseRange(text string) (int, int, error) {
+	start, count := 0, 1
+	if before, after, ok := strings.Cut(text, ","); ok {
+		if _, err := fmt.Sscanf(after, "%d", &count); err != nil {
+			return 0, 0, err
+		}
+		text = before
+	}
+	if _, err := fmt.Sscanf(text, "%d", &start); err != nil {
+		return 0, 0, err
+	}
+	return start, count, nil
+}
+
+// Apply applies hunks to the content they were made from. Every hunk must
+// match exactly; a patch made from other content is an error.
+func Apply(content string, hunks []Hunk) (string, error) {
+	lines := splitLines(content)
+
+	var result strings.Builder
+	cursor := 0
+
+	for i, hunk := range hunks {
+		// An empty range starts at the line before it
+		start := hunk.OldStart - 1
+		if hunk.OldCount == 0 {
+			start = hunk.OldStart
+		}
+		if start < cursor || start > len(lines) {
+			return "", fmt.Errorf("diff: hunk %d starts outside the file", i+1)
+		}
+
+		for _, text := range lines[cursor:start] {
+			result.WriteString(text)
+		}
+		cursor = start
+
+		for _, text := range hunk.Lines {
+			prefix, body := text[0], text[1:]
+			if prefix == '+' {
+				result.WriteString(body)
+				continue
+			}
+
+			if cursor >= len(lines) || lines[cursor] != body {
+				return "", fmt.Errorf("diff: hunk %d does not match at line %d", i+1, cursor+1)
+			}
+			if prefix == ' ' {
+				result.WriteString(body)
+			}
+			cursor++
+		}
+	}
+
+	for _, text := range lines[cursor:] {
+		result.WriteString(text)
+	}
+
+	return result.String(), nil
+}
@@ -0,0 +1,282 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Context is the number of unchanged lines shown around each change
+const Context = 3
+
+// maxEditDistance bounds the work spent finding the shortest diff. Files that
+// differ more than this are diffed as a whole replacement, which is still a
+// correct patch.
+const maxEditDistance = 4096
+
+// kind is what happens to a line
+type kind int
+
+const (
+	equal kind = iota
+	deleted
+	inserted
+)
+
+// line is a line of the diff, including its line terminator
+type line struct {
+	kind kind
+	text string
+}
+
+// Header describes the file a patch applies to
+type Header struct {
+	// The file's path relative to the repository root
+	File string
+	// The last commit that changed the file
+	BaseCommit string
+	// The git blob ids of the content before and after the change
+	OldBlob string
+	NewBlob string
+}
+
+// Patch returns a git-style unified diff from old to new, or an empty string
+// when they are the same. The base commit is written before the diff, where
+// git apply ignores it.
+func Patch(header Header, old string, new string) string {
+	if old == new {
+		return ""
+	}
+
+	var patch strings.Builder
+
+	if commit := strings.TrimSpace(header.BaseCommit); commit != "" {
+		fmt.Fprintf(&patch, "base-commit: %s\n", commit)
+	}
+	fmt.Fprintf(&patch, "diff --git a/%s b/%s\n", header.File, header.File)
+	if header.OldBlob != "" && header.NewBlob != "" {
+		fmt.Fprintf(&patch, "index %s..%s\n", header.OldBlob, header.NewBlob)
+	}
+	fmt.Fprintf(&patch, "--- a/%s\n", header.File)
+	fmt.Fprintf(&patch, "+++ b/%s\n", header.File)
+	patch.WriteString(Unified(old, new))
+
+	return patch.String()
+}
+
+// Unified returns the hunks of a unified diff from old to new
+func Unified(old string, new string) string {
+	lines := diffLines(splitLines(old), splitLines(new))
+
+	// The number of old and new lines before each line of the diff
+	oldBefore := make([]int, len(lines)+1)
+	newBefore := make([]int, len(lines)+1)
+	for i, l := range lines {
+		oldBefore[i+1] = oldBefore[i]
+		newBefore[i+1] = newBefore[i]
+		if l.kind != inserted {
+			oldBefore[i+1]++
+		}
+		if l.kind != deleted {
+			newBefore[i+1]++
+		}
+	}
+
+	var hunks strings.Builder
+	for i := 0; i < len(lines); {
+		for i < len(lines) && lines[i].kind == equal {
+			i++
+		}
+		if i == len(lines) {
+			break
+		}
+
+		// Extend the hunk over changes separated by little enough unchanged
+		// text that their context would overlap
+		end := i
+		for {
+			for end < len(lines) && lines[end].kind != equal {
+				end++
+			}
+			next := end
+			for next < len(lines) && lines[next].kind == equal {
+				next++
+			}
+			if next == len(lines) || next-end > 2*Context {
+				break
+			}
+			end = next
+		}
+
+		start := max(i-Context, 0)
+		stop := min(end+Context, len(lines))
+
+		fmt.Fprintf(&hunks, "@@ -%s +%s @@\n",
+			hunkRange(oldBefore[start], oldBefore[stop]-oldBefore[start]),
+			hunkRange(newBefore[start], newBefore[stop]-newBefore[start]),
+		)
+		for _, l := range lines[start:stop] {
+			switch l.kind {
+			case equal:
+				hunks.WriteString(" ")
+			case deleted:
+				hunks.WriteString("-")
+			case inserted:
+				hunks.WriteString("+")
+			}
+			hunks.WriteString(l.text)
+			if !strings.HasSuffix(l.text, "\n") {
+				hunks.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		i = stop
+	}
+
+	return hunks.String()
+}
+
+// hunkRange formats the start and length of a hunk's lines. An empty range
+// starts at the line before it.
+func hunkRange(before int, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", before)
+	case 1:
+		return fmt.Sprintf("%d", before+1)
+	default:
+		return fmt.Sprintf("%d,%d", before+1, count)
+	}
+}
+
+// splitLines splits text into lines, keeping each line's terminator
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the shortest list of lines turning a into b
+func diffLines(a []string, b []string) []line {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var lines []line
+	for _, text := range a[:prefix] {
+		lines = append(lines, line{equal, text})
+	}
+	lines = append(lines, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, text := range a[len(a)-suffix:] {
+		lines = append(lines, line{equal, text})
+	}
+
+	return lines
+}
+
+// myers finds the shortest edit script with Myers' O(ND) algorithm
+func myers(a []string, b []string) []line {
+	n, m := len(a), len(b)
+	offset := n + m
+	v := make([]int, 2*(n+m)+2)
+
+	// trace holds v for the diagonals -d to d after each step d
+	var trace [][]int
+
+	for d := 0; d <= n+m; d++ {
+		if d > maxEditDistance {
+			return replaceAll(a, b)
+		}
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+				return backtrack(trace, a, b)
+			}
+		}
+
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+	}
+
+	return replaceAll(a, b)
+}
+
+// backtrack walks the trace back from the end to recover the edit script
+func backtrack(trace [][]int, a []string, b []string) []line {
+	x, y := len(a), len(b)
+	var reversed []line
+
+	for d := len(trace) - 1; d > 0; d-- {
+		previous := func(k int) int {
+			return trace[d-1][k+d-1]
+		}
+
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && previous(k-1) < previous(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := previous(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			reversed = append(reversed, line{equal, a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			reversed = append(reversed, line{inserted, b[y-1]})
+			y--
+		} else {
+			reversed = append(reversed, line{deleted, a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		reversed = append(reversed, line{equal, a[x-1]})
+		x--
+		y--
+	}
+
+	lines := make([]line, len(reversed))
+	for i, l := range reversed {
+		lines[len(reversed)-1-i] = l
+	}
+	return lines
+}
+
+// replaceAll deletes every line of a and inserts every line of b
+func replaceAll(a []string, b []string) []line {
+	lines := make([]line, 0, len(a)+len(b))
+	for _, text := range a {
+		lines = append(lines, line{deleted, text})
+	}
+	for _, text := range b {
+		lines = append(lines, line{inserted, text})
+	}
+	return lines
+}
@@ -0,0 +1,158 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// numbered returns n lines "1\n" to "n\n", replacing the lines given by
+// their number
+func numbered(n int, replace map[int]string) string {
+	var text strings.Builder
+	for i := 1; i <= n; i++ {
+		if line, ok := replace[i]; ok {
+			text.WriteString(line + "\n")
+		} else {
+			fmt.Fprintf(&text, "%d\n", i)
+		}
+	}
+	return text.String()
+}
+
+var unifiedTests = []struct {
+	name string
+	old  string
+	new  string
+	want string
+}{
+	{
+		name: "unchanged",
+		old:  "a\nb\n",
+		new:  "a\nb\n",
+		want: "",
+	},
+	{
+		name: "changed line",
+		old:  "a\nb\nc\n",
+		new:  "a\nB\nc\n",
+		want: "@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+	},
+	{
+		name: "no final newline",
+		old:  "a\nb",
+		new:  "a\nc",
+		want: "@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n",
+	},
+	{
+		name: "final newline added",
+		old:  "a\nb",
+		new:  "a\nb\n",
+		want: "@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+	},
+	{
+		name: "final newline removed",
+		old:  "a\nb\n",
+		new:  "a\nb",
+		want: "@@ -1,2 +1,2 @@\n a\n-b\n+b\n\\ No newline at end of file\n",
+	},
+	{
+		name: "empty old file",
+		old:  "",
+		new:  "a\nb\n",
+		want: "@@ -0,0 +1,2 @@\n+a\n+b\n",
+	},
+	{
+		name: "empty new file",
+		old:  "a\nb\n",
+		new:  "",
+		want: "@@ -1,2 +0,0 @@\n-a\n-b\n",
+	},
+	{
+		name: "empty old file without final newline",
+		old:  "",
+		new:  "a",
+		want: "@@ -0,0 +1 @@\n+a\n\\ No newline at end of file\n",
+	},
+	{
+		name: "insertion at start",
+		old:  numbered(5, nil),
+		new:  "0\n" + numbered(5, nil),
+		want: "@@ -1,3 +1,4 @@\n+0\n 1\n 2\n 3\n",
+	},
+	{
+		name: "adjacent hunks merge",
+		old:  numbered(10, nil),
+		new:  numbered(10, map[int]string{2: "x", 8: "y"}),
+		want: "@@ -1,10 +1,10 @@\n 1\n-2\n+x\n 3\n 4\n 5\n 6\n 7\n-8\n+y\n 9\n 10\n",
+	},
+	{
+		name: "distant hunks stay apart",
+		old:  numbered(20, nil),
+		new:  numbered(20, map[int]string{2: "x", 18: "y"}),
+		want: "@@ -1,5 +1,5 @@\n 1\n-2\n+x\n 3\n 4\n 5\n" +
+			"@@ -15,6 +15,6 @@\n 15\n 16\n 17\n-18\n+y\n 19\n 20\n",
+	},
+}
+
+func TestUnified(t *testing.T) {
+	for _, test := range unifiedTests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Unified(test.old, test.new); got != test.want {
+				t.Errorf("Unified() =\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPatchRoundTrip(t *testing.T) {
+	header := Header{
+		File:       "src/app.ts",
+		BaseCommit: "0123456789abcdef0123456789abcdef01234567",
+		OldBlob:    "1111111111111111111111111111111111111111",
+		NewBlob:    "2222222222222222222222222222222222222222",
+	}
+
+	for _, test := range unifiedTests {
+		if test.old == test.new {
+			continue
+		}
+
+		t.Run(test.name, func(t *testing.T) {
+			patch := Patch(header, test.old, test.new)
+
+			parsed, hunks, err := Parse(patch)
+			if err != nil {
+				t.Fatalf("Parse() error: %v\n%s", err, patch)
+			}
+			if parsed != header {
+				t.Errorf("Parse() header = %+v, want %+v", parsed, header)
+			}
+
+			got, err := Apply(test.old, hunks)
+			if err != nil {
+				t.Fatalf("Apply() error: %v\n%s", err, patch)
+			}
+			if got != test.new {
+				t.Errorf("Apply() = %q, want %q", got, test.new)
+			}
+		})
+	}
+}
+
+func TestPatchUnchanged(t *testing.T) {
+	if patch := Patch(Header{File: "a.txt"}, "a\n", "a\n"); patch != "" {
+		t.Errorf("Patch() = %q, want no patch", patch)
+	}
+}
+
+func TestApplyMismatch(t *testing.T) {
+	_, hunks, err := Parse(Patch(Header{File: "a.txt"}, "a\nb\nc\n", "a\nB\nc\n"))
+	if err != nil {
+		t.Fatalf("Parse() error: %v", err)
+	}
+
+	if _, err := Apply("a\nchanged\nc\n", hunks); err == nil {
+		t.Error("Apply() to other content succeeded, want an error")
+	}
+}
@@ -0,0 +1,161 @@
+package edit
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Edit is a single change to a file. It either replaces the exact text in
+// Search, or, when Search is empty, replaces the lines StartLine to EndLine.
+type Edit struct {
+	// The exact text to replace, which must appear once in the file
+	Search string `json:"search"`
+	// The text to put in place of the search text or line range
+	Replace string `json:"replace"`
+	// The first line to replace, counting from 1
+	StartLine int `json:"start_line"`
+	// The last line to replace. One less than StartLine inserts the
+	// replacement before StartLine without removing anything.
+	EndLine int `json:"end_line"`
+}
+
+// span is the part of the original content an edit replaces
+type span struct {
+	start   int
+	end     int
+	replace string
+	index   int
+}
+
+// Error is an edit that couldn't be applied
+type Error struct {
+	// The edit's position in the list, counting from 1
+	Index  int
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("edit %d: %s", e.Index, e.Reason)
+}
+
+// Apply applies edits to content. Every edit refers to the original content,
+// not to the result of earlier edits, and no two edits may overlap. Nothing is
+// applied unless every edit can be.
+func Apply(content string, edits []Edit) (string, error) {
+	lines := lineOffsets(content)
+
+	spans := make([]span, 0, len(edits))
+	for i, edit := range edits {
+		s, err := locate(content, lines, edit)
+		if err != nil {
+			return "", &Error{Index: i + 1, Reason: err.Error()}
+		}
+		s.index = i + 1
+		spans = append(spans, s)
+	}
+
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].start < spans[j].start
+	})
+	for i := 1; i < len(spans); i++ {
+		if spans[i].start < spans[i-1].end {
+			return "", &Error{Index: spans[i].index, Reason: fmt.Sprintf("overlaps edit %d", spans[i-1].index)}
+		}
+	}
+
+	var result strings.Builder
+	last := 0
+	for _, s := range spans {
+		result.WriteString(content[last:s.start])
+		result.WriteString(s.replace)
+		last = s.end
+	}
+	result.WriteString(content[last:])
+
+	return result.String(), nil
+}
+
+// locate finds the part of the content an edit replaces
+func locate(content string, lines []int, edit Edit) (span, error) {
+	if edit.Search != "" {
+		start := strings.Index(content, edit.Search)
+		if start < 0 {
+			return span{}, fmt.Errorf("search text not found: %q", preview(edit.Search))
+		}
+		if strings.Contains(content[start+1:], edit.Search) {
+			return span{}, fmt.Errorf("search text appears more than once: %q", preview(edit.Search))
+		}
+		return span{start: start, end: start + len(edit.Search), replace: edit.Replace}, nil
+	}
+
+	// lines holds the offset of every line's start plus the end of the
+	// content, so there are len(lines)-1 lines
+	count := len(lines) - 1
+	if edit.StartLine < 1 || edit.StartLine > count+1 {
+		return span{}, fmt.Errorf("start line %d is outside the file's %d lines", edit.StartLine, count)
+	}
+	if edit.EndLine < edit.StartLine-1 || edit.EndLine > count {
+		return span{}, fmt.Errorf("end line %d is invalid for start line %d in the file's %d lines", edit.EndLine, edit.StartLine, count)
+	}
+
+	start, end := lines[edit.StartLine-1], lines[edit.EndLine]
+
+	// Keep whole lines: the replacement ends with a newline when the lines it
+	// replaces did or it is inserted between lines, and starts on a new line
+	// when it is appended to a file with no final newline
+	replace := edit.Replace
+	if replace != "" {
+		endsLine := end > start && content[end-1] == '\n'
+		inserted := end == start && (start < len(content) || (start > 0 && content[start-1] == '\n'))
+		if (endsLine || inserted) && !strings.HasSuffix(replace, "\n") {
+			replace += "\n"
+		}
+		if start == len(content) && start > 0 && content[start-1] != '\n' {
+			replace = "\n" + replace
+		}
+	}
+
+	return span{start: start, end: end, replace: replace}, nil
+}
+
+// NumberLines prefixes each line of content with its number and "| ", so that
+// line range edits can refer to lines without counting them
+func NumberLines(content string) string {
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	width := len(fmt.Sprint(len(lines)))
+
+	var numbered strings.Builder
+	for i, line := range lines {
+		fmt.Fprintf(&numbered, "%*d| %s", width, i+1, line)
+	}
+	return numbered.String()
+}
+
+// lineOffsets returns the offset at which each line starts, followed by the
+// length of the content
+func lineOffsets(content string) []int {
+	offsets := []int{0}
+	for i := 0; i < len(content); i++ {
+		if content[i] == '\n' && i+1 < len(content) {
+			offsets = append(offsets, i+1)
+		}
+	}
+	if content == "" {
+		return offsets
+	}
+	return append(offsets, len(content))
+}
+
+// preview shortens text for an error message
+func preview(text string) string {
+	const limit = 80
+	if len(text) <= limit {
+		return text
+	}
+	return text[:limit] + "..."
+}
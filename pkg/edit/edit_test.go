@@ -0,0 +1,204 @@
+package edit
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		edits   []Edit
+		want    string
+	}{
+		{
+			name:    "search and replace",
+			content: "a\nb\nc\n",
+			edits:   []Edit{{Search: "b\n", Replace: "B\n"}},
+			want:    "a\nB\nc\n",
+		},
+		{
+			name:    "line range",
+			content: "a\nb\nc\nd\n",
+			edits:   []Edit{{StartLine: 2, EndLine: 3, Replace: "x"}},
+			want:    "a\nx\nd\n",
+		},
+		{
+			name:    "delete lines",
+			content: "a\nb\nc\n",
+			edits:   []Edit{{StartLine: 2, EndLine: 2}},
+			want:    "a\nc\n",
+		},
+		{
+			name:    "insert before a line",
+			content: "a\nb\n",
+			edits:   []Edit{{StartLine: 2, EndLine: 1, Replace: "x"}},
+			want:    "a\nx\nb\n",
+		},
+		{
+			name:    "insert at start",
+			content: "a\nb\n",
+			edits:   []Edit{{StartLine: 1, EndLine: 0, Replace: "x\n"}},
+			want:    "x\na\nb\n",
+		},
+		{
+			name:    "insert at end",
+			content: "a\nb\n",
+			edits:   []Edit{{StartLine: 3, EndLine: 2, Replace: "x"}},
+			want:    "a\nb\nx\n",
+		},
+		{
+			name:    "insert into empty file",
+			content: "",
+			edits:   []Edit{{StartLine: 1, EndLine: 0, Replace: "x"}},
+			want:    "x",
+		},
+		{
+			name:    "replace last line without final newline",
+			content: "a\nb",
+			edits:   []Edit{{StartLine: 2, EndLine: 2, Replace: "x"}},
+			want:    "a\nx",
+		},
+		{
+			name:    "append to file without final newline",
+			content: "a\nb",
+			edits:   []Edit{{StartLine: 3, EndLine: 2, Replace: "x"}},
+			want:    "a\nb\nx",
+		},
+		{
+			name:    "search at end without final newline",
+			content: "a\nb",
+			edits:   []Edit{{Search: "b", Replace: "x"}},
+			want:    "a\nx",
+		},
+		{
+			name:    "edits refer to the original content",
+			content: "a\nb\nc\nd\n",
+			edits: []Edit{
+				{StartLine: 4, EndLine: 4, Replace: "D"},
+				{Search: "a\n", Replace: "1\n2\n"},
+				{StartLine: 2, EndLine: 2, Replace: "B"},
+			},
+			want: "1\n2\nB\nc\nD\n",
+		},
+		{
+			name:    "adjacent edits",
+			content: "a\nb\n",
+			edits: []Edit{
+				{StartLine: 1, EndLine: 1, Replace: "A"},
+				{StartLine: 2, EndLine: 2, Replace: "B"},
+			},
+			want: "A\nB\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Apply(test.content, test.edits)
+			if err != nil {
+				t.Fatalf("Apply() error: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("Apply() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		edits   []Edit
+		index   int
+		reason  string
+	}{
+		{
+			name:    "search text not found",
+			content: "a\nb\n",
+			edits:   []Edit{{Search: "c", Replace: "x"}},
+			index:   1,
+			reason:  "not found",
+		},
+		{
+			name:    "duplicate search text",
+			content: "a\nb\na\n",
+			edits: []Edit{
+				{Search: "b", Replace: "B"},
+				{Search: "a", Replace: "x"},
+			},
+			index:  2,
+			reason: "more than once",
+		},
+		{
+			name:    "overlapping line ranges",
+			content: "a\nb\nc\n",
+			edits: []Edit{
+				{StartLine: 1, EndLine: 2, Replace: "x"},
+				{StartLine: 2, EndLine: 3, Replace: "y"},
+			},
+			index:  2,
+			reason: "overlaps edit 1",
+		},
+		{
+			name:    "search overlapping a line range",
+			content: "a\nb\nc\n",
+			edits: []Edit{
+				{Search: "b\nc", Replace: "x"},
+				{StartLine: 1, EndLine: 2, Replace: "y"},
+			},
+			index:  1,
+			reason: "overlaps edit 2",
+		},
+		{
+			name:    "start line past the end",
+			content: "a\nb\n",
+			edits:   []Edit{{StartLine: 4, EndLine: 4, Replace: "x"}},
+			index:   1,
+			reason:  "outside the file",
+		},
+		{
+			name:    "end line before the insertion point",
+			content: "a\nb\n",
+			edits:   []Edit{{StartLine: 2, EndLine: 0, Replace: "x"}},
+			index:   1,
+			reason:  "end line 0 is invalid",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Apply(test.content, test.edits)
+			if err == nil {
+				t.Fatalf("Apply() = %q, want an error", got)
+			}
+
+			var editErr *Error
+			if !errors.As(err, &editErr) {
+				t.Fatalf("Apply() error %v is not an *Error", err)
+			}
+			if editErr.Index != test.index || !strings.Contains(editErr.Reason, test.reason) {
+				t.Errorf("Apply() error = %v, want edit %d: ...%s...", err, test.index, test.reason)
+			}
+		})
+	}
+}
+
+func TestNumberLines(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"a\nb\n", "1| a\n2| b\n"},
+		{"a\nb", "1| a\n2| b"},
+		{strings.Repeat("x\n", 10), " 1| x\n 2| x\n 3| x\n 4| x\n 5| x\n 6| x\n 7| x\n 8| x\n 9| x\n10| x\n"},
+	}
+
+	for _, test := range tests {
+		if got := NumberLines(test.content); got != test.want {
+			t.Errorf("NumberLines(%q) = %q, want %q", test.content, got, test.want)
+		}
+	}
+}
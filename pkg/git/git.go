@@ -1,7 +1,15 @@
 package git
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 )
 
 func GetFileCommit(file string) (string, error) {
@@ -23,3 +31,86 @@ func GetFileStage(file string) (string, error) {
 
 	return string(output), nil
 }
+
+// GetFileBlob returns the id of the file's blob in the git index, or an empty
+// string if the file isn't tracked
+func GetFileBlob(file string) (string, error) {
+	stage, err := GetFileStage(file)
+	if err != nil {
+		return "", err
+	}
+
+	// Each entry is "<mode> <blob> <stage>\t<path>"
+	fields := strings.Fields(stage)
+	if len(fields) < 2 {
+		return "", nil
+	}
+	return fields[1], nil
+}
+
+// HashBlob returns the id git gives a blob with this content
+func HashBlob(content []byte) string {
+	hash := sha1.New()
+	fmt.Fprintf(hash, "blob %d\x00", len(content))
+	hash.Write(content)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// ReadBlob returns the content of a blob in the repository
+func ReadBlob(id string) ([]byte, error) {
+	cmd := exec.Command("git", "cat-file", "blob", id)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("blob %s not found: %w", id, err)
+	}
+
+	return output, nil
+}
+
+// WriteBlob stores content as a blob in the repository's object database, so
+// that ReadBlob can return it later, and returns its id
+func WriteBlob(content []byte) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", "hash-object", "-w", "--stdin", "--no-filters")
+	cmd.Stdin = bytes.NewReader(content)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git hash-object: %w: %s", err, stderr.String())
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// MergeFile merges the changes from base to theirs into ours, returning the
+// merged content and whether any of the changes conflicted
+func MergeFile(ours []byte, base []byte, theirs []byte) ([]byte, bool, error) {
+	dir, err := os.MkdirTemp("", "baz-merge-")
+	if err != nil {
+		return nil, false, err
+	}
+	defer os.RemoveAll(dir)
+
+	paths := []string{filepath.Join(dir, "ours"), filepath.Join(dir, "base"), filepath.Join(dir, "theirs")}
+	for i, content := range [][]byte{ours, base, theirs} {
+		if err := os.WriteFile(paths[i], content, 0644); err != nil {
+			return nil, false, err
+		}
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", "merge-file", "-p", paths[0], paths[1], paths[2])
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		// merge-file exits with the number of conflicts, or above 127 when
+		// it fails
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 && exitErr.ExitCode() < 128 {
+			return output, true, nil
+		}
+		return nil, false, fmt.Errorf("git merge-file: %w: %s", err, stderr.String())
+	}
+
+	return output, false, nil
+}
@@ -28,7 +28,7 @@ func Load(root string) ([]string, error) {
 	}
 
 	// load ignore patterns from .bazignore
-	ignorePatterns, err := loadIgnorePatterns(".bazignore")
+	ignorePatterns, err := LoadIgnorePatterns(".bazignore")
 	if err != nil {
 		return nil, err
 	}
@@ -42,16 +42,9 @@ func Load(root string) ([]string, error) {
 	// filter files based on ignore patterns
 	filteredFiles := []string{}
 	for _, file := range files {
-		ignore := false
-		for _, pattern := range ignorePatterns {
-			matched, err := filepath.Match(pattern, file)
-			if err != nil {
-				return nil, err
-			}
-			if matched || strings.HasPrefix(file, pattern) {
-				ignore = true
-				break
-			}
+		ignore, err := Ignored(file, ignorePatterns)
+		if err != nil {
+			return nil, err
 		}
 		if !ignore {
 			filteredFiles = append(filteredFiles, file)
@@ -64,7 +57,23 @@ func Load(root string) ([]string, error) {
 	return filteredFiles, nil
 }
 
-func loadIgnorePatterns(path string) ([]string, error) {
+// Ignored reports whether a path relative to the root matches any of the
+// ignore patterns, either as a glob or as a prefix
+func Ignored(file string, patterns []string) (bool, error) {
+	for _, pattern := range patterns {
+		matched, err := filepath.Match(pattern, file)
+		if err != nil {
+			return false, err
+		}
+		if matched || strings.HasPrefix(file, pattern) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// LoadIgnorePatterns reads the patterns in an ignore file such as .bazignore
+func LoadIgnorePatterns(path string) ([]string, error) {
 	content, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
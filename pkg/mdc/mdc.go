@@ -2,91 +2,319 @@ package mdc
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/gobwas/glob"
 	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
 )
 
+// delimiter opens and closes the frontmatter
+const delimiter = "---"
+
+// ParseError is an error in an MDC file, at a line of the file
+type ParseError struct {
+	Line int
+	Err  error
+}
+
+// Error implements the error interface
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// yamlLine finds the frontmatter line in a YAML error
+var yamlLine = regexp.MustCompile(`line (\d+): `)
+
+// frontmatterError returns a ParseError for a YAML error, taking its line out
+// of the message and moving it past the opening delimiter
+func frontmatterError(err error) *ParseError {
+	message := err.Error()
+
+	line := 1
+	if loc := yamlLine.FindStringSubmatchIndex(message); loc != nil {
+		n, _ := strconv.Atoi(message[loc[2]:loc[3]])
+		line = n + 1
+		message = message[:loc[0]] + message[loc[1]:]
+	}
+
+	return &ParseError{Line: line, Err: fmt.Errorf("failed to parse frontmatter: %s", message)}
+}
+
+// Glob is a compiled glob pattern together with the pattern it was compiled
+// from
+type Glob struct {
+	glob.Glob
+	Pattern string
+}
+
+// CompileGlob compiles a glob pattern
+func CompileGlob(pattern string) (Glob, error) {
+	g, err := glob.Compile(pattern)
+	if err != nil {
+		return Glob{}, fmt.Errorf("failed to compile glob pattern '%s': %w", pattern, err)
+	}
+	return Glob{Glob: g, Pattern: pattern}, nil
+}
+
+// String returns the glob's pattern
+func (g Glob) String() string {
+	return g.Pattern
+}
+
 // Mdc represents a single MDC file with its metadata and content
 type Mdc struct {
 	// Frontmatter fields
-	Globs       []glob.Glob
+	Globs       []Glob
 	Description string
 	AlwaysApply bool
 	Path        string
 
+	// Optional model settings for rules that need a different model
+	Model           string
+	Temperature     *float64
+	MaxTokens       int64
+	ReasoningEffort string
+
+	// Frontmatter keys the tool doesn't use, kept so they are written back
+	Extras map[string]any
+
 	// The actual content of the rule file after the frontmatter
 	Content string
+
+	// The document as it was parsed, nil for rules built in code
+	source *source
 }
 
-// parseFrontmatter parses the frontmatter section into key-value pairs
-func parseFrontmatter(data []byte) (map[string]string, error) {
-	result := make(map[string]string)
-	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+// source is what Marshal needs to write a parsed document back out
+type source struct {
+	// Everything before the content: the delimiters and the frontmatter
+	header []byte
+	// The frontmatter as it was written
+	front []byte
+	// The frontmatter mapping, with its key order, styles and comments
+	node *yaml.Node
+	// The frontmatter as parsed
+	fields frontmatter
+}
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
+// frontmatter is the YAML frontmatter of an MDC file
+type frontmatter struct {
+	Description     string         `yaml:"description"`
+	Globs           globList       `yaml:"globs"`
+	AlwaysApply     bool           `yaml:"alwaysApply"`
+	Model           string         `yaml:"model"`
+	Temperature     *float64       `yaml:"temperature"`
+	MaxTokens       int64          `yaml:"maxTokens"`
+	ReasoningEffort string         `yaml:"reasoningEffort"`
+	Extras          map[string]any `yaml:",inline"`
+}
 
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) != 2 {
-			continue
+// globList is the globs key, either a comma-separated string as Cursor
+// writes it or a YAML list
+type globList []string
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (g *globList) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			*g = nil
+			return nil
+		}
+		*g = splitGlobs(node.Value)
+	case yaml.SequenceNode:
+		var patterns []string
+		if err := node.Decode(&patterns); err != nil {
+			return err
+		}
+		*g = nil
+		for _, pattern := range patterns {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				*g = append(*g, pattern)
+			}
 		}
+	default:
+		return fmt.Errorf("line %d: globs must be a string or a list", node.Line)
+	}
+	return nil
+}
 
-		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
+// values returns each frontmatter key that is set with its value
+func (f frontmatter) values() map[string]any {
+	values := map[string]any{}
+	for key, value := range f.Extras {
+		values[key] = value
+	}
 
-		// Remove any quotes around the value
-		value = strings.Trim(value, `"'`)
-		result[key] = value
+	if f.Description != "" {
+		values["description"] = f.Description
+	}
+	if len(f.Globs) > 0 {
+		values["globs"] = f.Globs
+	}
+	if f.AlwaysApply {
+		values["alwaysApply"] = true
+	}
+	if f.Model != "" {
+		values["model"] = f.Model
+	}
+	if f.Temperature != nil {
+		values["temperature"] = *f.Temperature
+	}
+	if f.MaxTokens > 0 {
+		values["maxTokens"] = f.MaxTokens
+	}
+	if f.ReasoningEffort != "" {
+		values["reasoningEffort"] = f.ReasoningEffort
 	}
 
-	return result, nil
+	return values
 }
 
-// parseGlobs parses and compiles a comma-separated string of glob patterns
-func parseGlobs(globStr string) ([]glob.Glob, error) {
-	var globs []glob.Glob
+// keyOrder is the order in which new keys are written
+var keyOrder = []string{"description", "globs", "alwaysApply", "model", "temperature", "maxTokens", "reasoningEffort"}
+
+// splitGlobs splits a comma-separated string of glob patterns, leaving the
+// commas inside braces such as *.{ts,tsx} alone
+func splitGlobs(globStr string) []string {
+	var (
+		patterns []string
+		depth    int
+		start    int
+	)
+
+	add := func(pattern string) {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
 
-	// Handle both comma-separated and single value formats
-	var patterns []string
-	if strings.Contains(globStr, ",") {
-		// Split by comma and trim spaces
-		parts := strings.Split(globStr, ",")
-		patterns = make([]string, 0, len(parts))
-		for _, p := range parts {
-			p = strings.TrimSpace(p)
-			if p != "" {
-				patterns = append(patterns, p)
+	for i, r := range globStr {
+		switch r {
+		case '{', '[':
+			depth++
+		case '}', ']':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				add(globStr[start:i])
+				start = i + 1
 			}
 		}
-	} else {
-		// Single glob
-		pattern := strings.TrimSpace(globStr)
-		if pattern != "" {
-			patterns = []string{pattern}
+	}
+	add(globStr[start:])
+
+	// An unclosed brace or bracket would swallow the patterns after it, so
+	// they are split at every comma instead and fail to compile on their own
+	if depth > 0 {
+		patterns = nil
+		for _, pattern := range strings.Split(globStr, ",") {
+			add(pattern)
 		}
 	}
 
-	// Compile all patterns
-	globs = make([]glob.Glob, 0, len(patterns))
-	for _, pattern := range patterns {
-		g, err := glob.Compile(pattern)
-		if err != nil {
-			return nil, fmt.Errorf("failed to compile glob pattern '%s': %w", pattern, err)
+	return patterns
+}
+
+// splitDocument splits an MDC file into its header, the frontmatter between
+// the delimiters and the content after them. Only a line holding nothing but
+// the delimiter closes the frontmatter, so the content may use --- freely.
+func splitDocument(data []byte) (header []byte, front []byte, content []byte, err error) {
+	first, rest, ok := bytes.Cut(data, []byte("\n"))
+	if !ok || string(bytes.TrimRight(first, "\r")) != delimiter {
+		return nil, nil, nil, fmt.Errorf("invalid MDC format: missing frontmatter delimiters")
+	}
+
+	offset := len(first) + 1
+	for len(rest) > 0 {
+		line, next, found := bytes.Cut(rest, []byte("\n"))
+		end := offset + len(line)
+		if found {
+			end++
 		}
-		globs = append(globs, g)
+
+		if string(bytes.TrimRight(line, "\r")) == delimiter {
+			return data[:end], data[len(first)+1 : offset], data[end:], nil
+		}
+
+		offset, rest = end, next
+	}
+
+	return nil, nil, nil, fmt.Errorf("invalid MDC format: missing frontmatter delimiters")
+}
+
+// quotePlainValues quotes single-line top-level values that Cursor writes
+// unquoted but YAML can't read as they are: values starting with * (an alias
+// in YAML) or containing ": " or " #" (a comment in YAML), and globs starting
+// with YAML's other indicators, such as !negated or {a,b}/*. A line is replaced by exactly one
+// line, so YAML's line numbers still match the file's.
+func quotePlainValues(front []byte) []byte {
+	lines := strings.Split(string(front), "\n")
+
+	for i, line := range lines {
+		if line == "" || line[0] == ' ' || line[0] == '\t' || line[0] == '#' {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || strings.ContainsAny(key, " \t") {
+			continue
+		}
+		value = strings.TrimSpace(strings.TrimRight(value, "\r"))
+		if value == "" {
+			continue
+		}
+		if key == "globs" {
+			// Globs are never a mapping, an anchor or a tag; a list or a
+			// block scalar is left to YAML
+			if strings.ContainsAny(value[:1], `"'[|>#`) {
+				continue
+			}
+		} else if strings.ContainsAny(value[:1], `"'[{|>&!#`) ||
+			(!strings.HasPrefix(value, "*") && !strings.Contains(value, ": ") && !strings.Contains(value, " #")) {
+			continue
+		}
+		// A value continued on the next line is left to YAML
+		if i+1 < len(lines) && strings.HasPrefix(lines[i+1], " ") {
+			continue
+		}
+
+		lines[i] = key + ": '" + strings.ReplaceAll(value, "'", "''") + "'"
 	}
 
-	return globs, nil
+	return []byte(strings.Join(lines, "\n"))
 }
 
 // ParseBytes parses a byte slice containing an MDC file
 func ParseBytes(data []byte) (*Mdc, error) {
+	mdc, problems, err := ParseAll(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		return nil, &ParseError{Line: problems[0].Line, Err: errors.New(problems[0].Message)}
+	}
+	return mdc, nil
+}
+
+// ParseAll parses an MDC file like ParseBytes, but keeps going past globs
+// that don't compile. The rule has the globs that do, and each one that
+// doesn't is returned as a problem at its own line.
+func ParseAll(data []byte) (*Mdc, []Problem, error) {
 	mdc := &Mdc{}
 
 	log.Trace().
@@ -94,132 +322,442 @@ func ParseBytes(data []byte) (*Mdc, error) {
 		Msg("Parsing MDC")
 
 	// Split the content into frontmatter and markdown
-	parts := bytes.Split(data, []byte("---\n"))
-	if len(parts) < 3 {
-		return nil, fmt.Errorf("invalid MDC format: missing frontmatter delimiters")
+	header, front, content, err := splitDocument(data)
+	if err != nil {
+		return nil, nil, &ParseError{Line: 1, Err: err}
 	}
 
 	// Parse the frontmatter
-	frontmatter, err := parseFrontmatter(parts[1])
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse frontmatter: %w", err)
+	var document yaml.Node
+	if err := yaml.Unmarshal(quotePlainValues(front), &document); err != nil {
+		return nil, nil, frontmatterError(err)
 	}
 
-	// Set the fields
-	mdc.Description = frontmatter["description"]
+	node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if len(document.Content) > 0 && document.Content[0].Tag != "!!null" {
+		node = document.Content[0]
+		if node.Kind != yaml.MappingNode {
+			return nil, nil, &ParseError{Line: node.Line + 1, Err: fmt.Errorf("failed to parse frontmatter: expected keys and values")}
+		}
+	}
+
+	var fields frontmatter
+	if err := node.Decode(&fields); err != nil {
+		return nil, nil, frontmatterError(err)
+	}
+	if fields.Extras == nil {
+		fields.Extras = map[string]any{}
+	}
+
+	// Marshal compares against the frontmatter as it was read, so the source
+	// keeps its own copy of values the caller may change in place
+	var original frontmatter
+	if err := node.Decode(&original); err != nil {
+		return nil, nil, frontmatterError(err)
+	}
 
 	// Parse and compile globs
-	if globsStr, ok := frontmatter["globs"]; ok {
-		globs, err := parseGlobs(globsStr)
+	var (
+		globs    []Glob
+		problems []Problem
+		lines    = globLines(node)
+	)
+	for i, pattern := range fields.Globs {
+		g, err := CompileGlob(pattern)
 		if err != nil {
-			return nil, err
+			problems = append(problems, Problem{Line: lines[i], Severity: SeverityError, Message: err.Error()})
+			continue
 		}
-		mdc.Globs = globs
+		globs = append(globs, g)
 	}
 
-	// Parse alwaysApply
-	if alwaysApply, ok := frontmatter["alwaysApply"]; ok {
-		mdc.AlwaysApply = strings.ToLower(alwaysApply) == "true"
+	// Set the fields
+	mdc.Description = fields.Description
+	mdc.Globs = globs
+	mdc.AlwaysApply = fields.AlwaysApply
+	mdc.Model = fields.Model
+	mdc.Temperature = fields.Temperature
+	mdc.MaxTokens = fields.MaxTokens
+	mdc.ReasoningEffort = fields.ReasoningEffort
+	mdc.Extras = fields.Extras
+
+	// Store the markdown content (everything after the closing ---)
+	mdc.Content = string(content)
+
+	mdc.source = &source{
+		header: header,
+		front:  front,
+		node:   node,
+		fields: original,
 	}
 
-	// Store the markdown content (everything after the second ---)
-	mdc.Content = string(bytes.Join(parts[2:], []byte("---\n")))
-
-	return mdc, nil
+	return mdc, problems, nil
 }
 
-// getGlobPattern extracts the original pattern from a compiled glob
-func getGlobPattern(g glob.Glob) string {
-	// Since glob.Glob doesn't expose its pattern, we need to match against test cases
-	// to determine the original pattern
-	testCases := map[string][]struct {
-		input string
-		match bool
-	}{
-		"*.ts": {
-			{"test.ts", true},
-			{"test.js", false},
-			{"src/test.ts", false},
-		},
-		"src/*.ts": {
-			{"test.ts", false},
-			{"src/test.ts", true},
-			{"src/test.js", false},
-		},
-		"**/*.ts": {
-			{"test.ts", true},
-			{"src/test.ts", true},
-			{"src/nested/test.ts", true},
-			{"test.js", false},
-		},
-	}
-
-	for pattern, cases := range testCases {
-		matches := true
-		for _, tc := range cases {
-			if g.Match(tc.input) != tc.match {
-				matches = false
-				break
+// globLines returns the file line of each glob pattern: each item's own line
+// in a list, or the key's line for a comma-separated string
+func globLines(node *yaml.Node) []int {
+	var lines []int
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != "globs" {
+			continue
+		}
+
+		value := node.Content[i+1]
+		if value.Kind == yaml.SequenceNode {
+			for _, item := range value.Content {
+				if strings.TrimSpace(item.Value) != "" {
+					lines = append(lines, item.Line+1)
+				}
 			}
+			return lines
 		}
-		if matches {
-			return pattern
+		for range splitGlobs(value.Value) {
+			lines = append(lines, node.Content[i].Line+1)
 		}
+		return lines
 	}
+	return lines
+}
 
-	// If we can't determine the exact pattern, return a default
-	return "*.ts"
+// keyLine returns the file line of a key in the frontmatter, or the opening
+// delimiter's line if the key isn't there
+func keyLine(node *yaml.Node, key string) int {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i].Line + 1
+		}
+	}
+	return 1
 }
 
-// Marshal converts an MDC struct back to bytes
-func (m *Mdc) Marshal() ([]byte, error) {
-	var buf bytes.Buffer
-	buf.WriteString("---\n")
+// Line returns the line of a frontmatter key in the rule's file, or the first
+// line if the key isn't set
+func (m *Mdc) Line(key string) int {
+	if m.source == nil {
+		return 1
+	}
+	return keyLine(m.source.node, key)
+}
+
+// ContentLine returns the line of the rule's file where its content starts
+func (m *Mdc) ContentLine() int {
+	if m.source == nil {
+		return 1
+	}
+	return bytes.Count(m.source.header, []byte("\n")) + 1
+}
 
-	// Write description if present
-	if m.Description != "" {
-		buf.WriteString(fmt.Sprintf("description: %s\n", m.Description))
+// frontmatter returns the rule's frontmatter
+func (m *Mdc) frontmatter() frontmatter {
+	return frontmatter{
+		Description:     m.Description,
+		Globs:           m.Patterns(),
+		AlwaysApply:     m.AlwaysApply,
+		Model:           m.Model,
+		Temperature:     m.Temperature,
+		MaxTokens:       m.MaxTokens,
+		ReasoningEffort: m.ReasoningEffort,
+		Extras:          m.Extras,
 	}
+}
 
-	// Write globs if present
-	if len(m.Globs) > 0 {
-		patterns := make([]string, len(m.Globs))
-		for i, g := range m.Globs {
-			patterns[i] = getGlobPattern(g)
+// Marshal converts an MDC struct back to bytes. A parsed rule whose
+// frontmatter hasn't changed is written back exactly as it was read; otherwise
+// only the keys that changed are rewritten, and every other line, comments
+// included, is kept as it was.
+func (m *Mdc) Marshal() ([]byte, error) {
+	values := m.frontmatter().values()
+
+	var (
+		lines   []string
+		written = map[string]bool{}
+	)
+	if m.source != nil {
+		if reflect.DeepEqual(values, m.source.fields.values()) {
+			return append(append([]byte{}, m.source.header...), m.Content...), nil
 		}
-		buf.WriteString(fmt.Sprintf("globs: %s\n", strings.Join(patterns, ", ")))
+
+		var err error
+		if lines, err = m.source.rewrite(values, written); err != nil {
+			return nil, err
+		}
+	}
+
+	// Then add the keys that are new, known keys first
+	var extras []string
+	for key := range values {
+		extras = append(extras, key)
 	}
+	sort.Strings(extras)
+
+	for _, key := range append(append([]string{}, keyOrder...), extras...) {
+		value, ok := values[key]
+		if !ok || written[key] {
+			continue
+		}
 
-	// Write alwaysApply if true
-	if m.AlwaysApply {
-		buf.WriteString("alwaysApply: true\n")
+		entry, err := encodeEntry(key, value, nil)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, entry...)
+		written[key] = true
 	}
 
-	buf.WriteString("---\n")
+	var buf bytes.Buffer
+	buf.WriteString(delimiter + "\n")
+	for _, line := range lines {
+		buf.WriteString(line + "\n")
+	}
+	buf.WriteString(delimiter + "\n")
 	buf.WriteString(m.Content)
 
 	return buf.Bytes(), nil
 }
 
+// rewrite returns the lines of the frontmatter with the keys whose values
+// changed re-encoded and the keys that were cleared removed, marking the keys
+// it wrote. Every other line is kept as it was written.
+func (s *source) rewrite(values map[string]any, written map[string]bool) ([]string, error) {
+	var lines []string
+	if len(s.front) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(s.front), "\n"), "\n")
+	}
+	previous := s.fields.values()
+
+	var (
+		out []string
+		// The lines before this one have been written
+		last int
+	)
+	for i := 0; i+1 < len(s.node.Content); i += 2 {
+		key, value := s.node.Content[i], s.node.Content[i+1]
+
+		next := len(lines)
+		if i+2 < len(s.node.Content) {
+			next = s.node.Content[i+2].Line - 1
+		}
+		start, end := key.Line-1, entryEnd(lines, key.Line-1, next)
+
+		current, ok := values[key.Value]
+		_, wasSet := previous[key.Value]
+		switch {
+		case !ok && wasSet:
+			// The key has been cleared, so it goes with its comments
+			out = append(out, lines[last:commentStart(lines, start, last)]...)
+		case ok && !reflect.DeepEqual(current, previous[key.Value]):
+			entry, err := encodeEntry(key.Value, current, value)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, lines[last:start]...)
+			out = append(out, entry...)
+			written[key.Value] = true
+		default:
+			// Unchanged keys, and keys that were empty like
+			// alwaysApply: false, stay as they were
+			out = append(out, lines[last:end]...)
+			written[key.Value] = true
+		}
+		last = end
+	}
+
+	return append(out, lines[last:]...), nil
+}
+
+// entryEnd returns the line after a key's value, which runs from the key's
+// line up to the next key, leaving out the blank lines and comments before it
+func entryEnd(lines []string, start int, next int) int {
+	end := next
+	for end > start+1 {
+		line := strings.TrimRight(lines[end-1], "\r")
+		if strings.TrimSpace(line) != "" && !strings.HasPrefix(line, "#") {
+			break
+		}
+		end--
+	}
+	return end
+}
+
+// commentStart returns the first line of the comment directly above a key
+func commentStart(lines []string, start int, last int) int {
+	for start > last && strings.HasPrefix(lines[start-1], "#") {
+		start--
+	}
+	return start
+}
+
+// encodeEntry returns the lines of a frontmatter key and its value. Strings
+// are written unquoted, as Cursor writes them, whenever they read back the
+// same, and the comment after the previous value is kept.
+func encodeEntry(key string, value any, previous *yaml.Node) ([]string, error) {
+	var comment string
+	if previous != nil {
+		comment = previous.LineComment
+	}
+
+	if text, ok := plainValue(value, previous); ok {
+		line := key + ": " + text
+		if decoded, err := readEntry(line); err == nil && decoded == text {
+			if comment != "" {
+				line += " " + comment
+			}
+			return []string{line}, nil
+		}
+	}
+
+	encoded, err := encodeValue(value, previous)
+	if err != nil {
+		return nil, err
+	}
+	encoded.LineComment = comment
+
+	node := &yaml.Node{
+		Kind:    yaml.MappingNode,
+		Tag:     "!!map",
+		Content: []*yaml.Node{{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, encoded},
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(node); err != nil {
+		return nil, fmt.Errorf("failed to write frontmatter: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write frontmatter: %w", err)
+	}
+
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n"), nil
+}
+
+// plainValue returns the text of a value that could be written unquoted: a
+// string, or globs that weren't a list
+func plainValue(value any, previous *yaml.Node) (string, bool) {
+	switch value := value.(type) {
+	case string:
+		return value, !strings.ContainsAny(value, "\r\n")
+	case globList:
+		if previous != nil && previous.Kind == yaml.SequenceNode {
+			return "", false
+		}
+		return strings.Join(value, ", "), true
+	}
+	return "", false
+}
+
+// readEntry reads back the string value of a single frontmatter line the way
+// ParseBytes would
+func readEntry(line string) (string, error) {
+	var decoded map[string]any
+	if err := yaml.Unmarshal(quotePlainValues([]byte(line)), &decoded); err != nil {
+		return "", err
+	}
+	for _, value := range decoded {
+		if text, ok := value.(string); ok {
+			return text, nil
+		}
+	}
+	return "", fmt.Errorf("not a string")
+}
+
+// encodeValue returns the YAML node for a frontmatter value. Globs are
+// written as a list if they were one, and otherwise comma-separated.
+func encodeValue(value any, previous *yaml.Node) (*yaml.Node, error) {
+	if globs, ok := value.(globList); ok {
+		if previous != nil && previous.Kind == yaml.SequenceNode {
+			value = []string(globs)
+		} else {
+			value = strings.Join(globs, ", ")
+		}
+	}
+
+	var node yaml.Node
+	if err := node.Encode(value); err != nil {
+		return nil, fmt.Errorf("failed to write frontmatter: %w", err)
+	}
+	return &node, nil
+}
+
 // Unmarshal parses an MDC struct from a byte slice
 func Unmarshal(data []byte) (*Mdc, error) {
 	return ParseBytes(data)
 }
 
-// Validate checks if the MDC struct has all required fields
-func (m *Mdc) Validate() error {
-	var errors []string
+// Patterns returns the patterns of the rule's globs
+func (m *Mdc) Patterns() []string {
+	patterns := make([]string, len(m.Globs))
+	for i, g := range m.Globs {
+		patterns[i] = g.Pattern
+	}
+	return patterns
+}
+
+// Severity is how serious a problem with a rule is
+type Severity string
 
-	if m.Description == "" {
-		errors = append(errors, "description is required")
+const (
+	// SeverityError problems stop the rule from working as intended
+	SeverityError Severity = "error"
+	// SeverityWarning problems are likely mistakes
+	SeverityWarning Severity = "warning"
+)
+
+// Problem is something wrong with a rule, at a line of its file
+type Problem struct {
+	Line     int      `json:"line"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+}
+
+// ValidationError lists the problems found with a rule
+type ValidationError struct {
+	Problems []Problem
+}
+
+// Error implements the error interface
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		messages[i] = problem.Message
 	}
+	return fmt.Sprintf("validation failed: %s", strings.Join(messages, ", "))
+}
 
-	if len(m.Globs) == 0 {
-		errors = append(errors, "at least one glob pattern is required")
+// Validate checks if the MDC struct has all required fields. Any problems,
+// warnings included, are returned as a *ValidationError.
+func (m *Mdc) Validate() error {
+	var problems []Problem
+
+	// Globs that failed to compile still show which files the rule was meant
+	// for
+	hasGlobs := len(m.Globs) > 0 || (m.source != nil && len(m.source.fields.Globs) > 0)
+
+	switch {
+	case m.Description == "" && !hasGlobs && !m.AlwaysApply:
+		// A manual rule, which is only applied when named
+		problems = append(problems, Problem{
+			Line:     m.Line("description"),
+			Severity: SeverityWarning,
+			Message:  "rule has no description, globs or alwaysApply, so it only applies when named with -rules",
+		})
+	case m.Description == "":
+		problems = append(problems, Problem{
+			Line:     m.Line("description"),
+			Severity: SeverityError,
+			Message:  "description is required",
+		})
+	case !hasGlobs && !m.AlwaysApply:
+		problems = append(problems, Problem{
+			Line:     m.Line("globs"),
+			Severity: SeverityWarning,
+			Message:  "rule has neither alwaysApply nor globs, so it only applies when requested",
+		})
 	}
 
-	if len(errors) > 0 {
-		return fmt.Errorf("validation failed: %s", strings.Join(errors, ", "))
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
 	}
 
 	return nil
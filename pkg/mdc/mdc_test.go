@@ -0,0 +1,379 @@
+package mdc
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRepoRulesRoundTrip(t *testing.T) {
+	paths, err := filepath.Glob("../../.cursor/rules/*.mdc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no rules found in .cursor/rules")
+	}
+
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rule, err := ParseBytes(data)
+			if err != nil {
+				t.Fatalf("ParseBytes() error: %v", err)
+			}
+
+			unchanged, err := rule.Marshal()
+			if err != nil {
+				t.Fatalf("Marshal() error: %v", err)
+			}
+			if string(unchanged) != string(data) {
+				t.Errorf("Marshal() of an unchanged rule =\n%s\nwant\n%s", unchanged, data)
+			}
+
+			// Editing one key leaves every other line as it was
+			rule.Description += " (edited)"
+			edited, err := rule.Marshal()
+			if err != nil {
+				t.Fatalf("Marshal() error: %v", err)
+			}
+
+			want := strings.Replace(string(data), "description: "+strings.TrimSuffix(rule.Description, " (edited)"), "description: "+rule.Description, 1)
+			if string(edited) != want {
+				t.Errorf("Marshal() of an edited rule =\n%s\nwant\n%s", edited, want)
+			}
+
+			reparsed, err := ParseBytes(edited)
+			if err != nil {
+				t.Fatalf("ParseBytes() of the edited rule error: %v", err)
+			}
+			if reparsed.Description != rule.Description ||
+				!reflect.DeepEqual(reparsed.Patterns(), rule.Patterns()) ||
+				reparsed.AlwaysApply != rule.AlwaysApply ||
+				reparsed.Content != rule.Content {
+				t.Errorf("edited rule reads back as %+v, want %+v", reparsed, rule)
+			}
+		})
+	}
+}
+
+func TestParseGlobs(t *testing.T) {
+	tests := []struct {
+		name  string
+		globs string
+		want  []string
+	}{
+		{"star", "globs: *", []string{"*"}},
+		{"comma-separated", "globs: *.ts, src/**/*.go", []string{"*.ts", "src/**/*.go"}},
+		{"braces", "globs: *.{ts,tsx}, *.md", []string{"*.{ts,tsx}", "*.md"}},
+		{"starting with a brace", "globs: {src,lib}/*.ts", []string{"{src,lib}/*.ts"}},
+		{"starting with !", "globs: !*.test.ts", []string{"!*.test.ts"}},
+		{"starting with &", "globs: &*.ts", []string{"&*.ts"}},
+		{"quoted", `globs: "*.ts, *.js"`, []string{"*.ts", "*.js"}},
+		{"flow list", "globs: ['*.ts', '{a,b}/*.md']", []string{"*.ts", "{a,b}/*.md"}},
+		{"block list", "globs:\n  - '*.ts'\n  - docs/*.md", []string{"*.ts", "docs/*.md"}},
+		{"empty", "globs:", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule, err := ParseBytes([]byte("---\ndescription: Test\n" + test.globs + "\n---\nBody\n"))
+			if err != nil {
+				t.Fatalf("ParseBytes() error: %v", err)
+			}
+			if got := rule.Patterns(); strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("Patterns() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseDescription(t *testing.T) {
+	tests := []struct {
+		front string
+		want  string
+	}{
+		{"description: Naming: use camelCase", "Naming: use camelCase"},
+		{"description: Issue #12 tracking", "Issue #12 tracking"},
+		{"description: Plain # comment", "Plain # comment"},
+		{"description: 'Quoted' # comment", "Quoted"},
+		{"description: *.md files", "*.md files"},
+	}
+
+	for _, test := range tests {
+		rule, err := ParseBytes([]byte("---\n" + test.front + "\n---\nBody\n"))
+		if err != nil {
+			t.Fatalf("ParseBytes(%q) error: %v", test.front, err)
+		}
+		if rule.Description != test.want {
+			t.Errorf("ParseBytes(%q).Description = %q, want %q", test.front, rule.Description, test.want)
+		}
+	}
+}
+
+func TestMarshalHash(t *testing.T) {
+	rule, err := ParseBytes([]byte("---\ndescription: Issue #12 tracking\nglobs: *.md\n---\nBody\n"))
+	if err != nil {
+		t.Fatalf("ParseBytes() error: %v", err)
+	}
+
+	rule.Description = "Issue #13 tracking"
+	got, err := rule.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+
+	want := "---\ndescription: Issue #13 tracking\nglobs: *.md\n---\nBody\n"
+	if string(got) != want {
+		t.Errorf("Marshal() =\n%s\nwant\n%s", got, want)
+	}
+
+	reparsed, err := ParseBytes(got)
+	if err != nil {
+		t.Fatalf("ParseBytes() of the result error: %v", err)
+	}
+	if reparsed.Description != rule.Description {
+		t.Errorf("Description reads back as %q, want %q", reparsed.Description, rule.Description)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	const source = "---\n" +
+		"# Applies to every file\n" +
+		"description: Style: keep it short\n" +
+		"globs: *\n" +
+		"alwaysApply: false\n" +
+		"# Who to ask\n" +
+		"owner: docs-team\n" +
+		"tags:\n" +
+		"  - style\n" +
+		"---\n" +
+		"Body\n"
+
+	tests := []struct {
+		name   string
+		change func(rule *Mdc)
+		want   string
+	}{
+		{
+			name:   "unchanged",
+			change: func(rule *Mdc) {},
+			want:   source,
+		},
+		{
+			name:   "new key",
+			change: func(rule *Mdc) { rule.Model = "gpt-4o-mini" },
+			want: "---\n" +
+				"# Applies to every file\n" +
+				"description: Style: keep it short\n" +
+				"globs: *\n" +
+				"alwaysApply: false\n" +
+				"# Who to ask\n" +
+				"owner: docs-team\n" +
+				"tags:\n" +
+				"  - style\n" +
+				"model: gpt-4o-mini\n" +
+				"---\n" +
+				"Body\n",
+		},
+		{
+			name: "changed keys",
+			change: func(rule *Mdc) {
+				rule.Globs = []Glob{mustCompile(t, "*.md"), mustCompile(t, "{docs,guides}/*.txt")}
+				rule.Extras["owner"] = "Ops: on call"
+			},
+			want: "---\n" +
+				"# Applies to every file\n" +
+				"description: Style: keep it short\n" +
+				"globs: *.md, {docs,guides}/*.txt\n" +
+				"alwaysApply: false\n" +
+				"# Who to ask\n" +
+				"owner: Ops: on call\n" +
+				"tags:\n" +
+				"  - style\n" +
+				"---\n" +
+				"Body\n",
+		},
+		{
+			name:   "changed list",
+			change: func(rule *Mdc) { rule.Extras["tags"] = []any{"style", "docs"} },
+			want: "---\n" +
+				"# Applies to every file\n" +
+				"description: Style: keep it short\n" +
+				"globs: *\n" +
+				"alwaysApply: false\n" +
+				"# Who to ask\n" +
+				"owner: docs-team\n" +
+				"tags:\n" +
+				"  - style\n" +
+				"  - docs\n" +
+				"---\n" +
+				"Body\n",
+		},
+		{
+			name:   "cleared key",
+			change: func(rule *Mdc) { delete(rule.Extras, "owner") },
+			want: "---\n" +
+				"# Applies to every file\n" +
+				"description: Style: keep it short\n" +
+				"globs: *\n" +
+				"alwaysApply: false\n" +
+				"tags:\n" +
+				"  - style\n" +
+				"---\n" +
+				"Body\n",
+		},
+		{
+			name:   "content",
+			change: func(rule *Mdc) { rule.Content = "New body\n" },
+			want:   strings.Replace(source, "Body\n", "New body\n", 1),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule, err := ParseBytes([]byte(source))
+			if err != nil {
+				t.Fatalf("ParseBytes() error: %v", err)
+			}
+
+			test.change(rule)
+			got, err := rule.Marshal()
+			if err != nil {
+				t.Fatalf("Marshal() error: %v", err)
+			}
+			if string(got) != test.want {
+				t.Errorf("Marshal() =\n%s\nwant\n%s", got, test.want)
+			}
+
+			reparsed, err := ParseBytes(got)
+			if err != nil {
+				t.Fatalf("ParseBytes() of the result error: %v", err)
+			}
+			if !reflect.DeepEqual(reparsed.frontmatter().values(), rule.frontmatter().values()) {
+				t.Errorf("result reads back as %v, want %v", reparsed.frontmatter().values(), rule.frontmatter().values())
+			}
+		})
+	}
+}
+
+func TestMarshalNew(t *testing.T) {
+	rule := &Mdc{
+		Description: "Markdown: formatting",
+		Globs:       []Glob{mustCompile(t, "*.md")},
+		Content:     "Body\n",
+	}
+
+	got, err := rule.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+
+	want := "---\ndescription: Markdown: formatting\nglobs: *.md\n---\nBody\n"
+	if string(got) != want {
+		t.Errorf("Marshal() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestParseErrorLine(t *testing.T) {
+	_, err := ParseBytes([]byte("---\ndescription: Test\nalwaysApply: maybe\n---\nBody\n"))
+
+	parseErr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("ParseBytes() error = %v, want a *ParseError", err)
+	}
+	if parseErr.Line != 3 {
+		t.Errorf("ParseError.Line = %d, want 3", parseErr.Line)
+	}
+}
+
+func mustCompile(t *testing.T, pattern string) Glob {
+	t.Helper()
+	g, err := CompileGlob(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestParseAllGlobProblems(t *testing.T) {
+	tests := []struct {
+		name     string
+		globs    string
+		patterns []string
+		lines    []int
+	}{
+		{"comma-separated", "globs: src/[, *.md, lib/[a", []string{"*.md"}, []int{2, 2}},
+		{"list", "globs:\n  - src/[\n  - '*.md'\n  - lib/[a", []string{"*.md"}, []int{3, 5}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule, problems, err := ParseAll([]byte("---\n" + test.globs + "\n---\nBody\n"))
+			if err != nil {
+				t.Fatalf("ParseAll() error: %v", err)
+			}
+			if !reflect.DeepEqual(rule.Patterns(), test.patterns) {
+				t.Errorf("Patterns() = %q, want %q", rule.Patterns(), test.patterns)
+			}
+
+			var lines []int
+			for _, problem := range problems {
+				if problem.Severity != SeverityError {
+					t.Errorf("problem %q is a %s, want an error", problem.Message, problem.Severity)
+				}
+				lines = append(lines, problem.Line)
+			}
+			if !reflect.DeepEqual(lines, test.lines) {
+				t.Errorf("problem lines = %v, want %v", lines, test.lines)
+			}
+
+			if _, err := ParseBytes([]byte("---\n" + test.globs + "\n---\nBody\n")); err == nil {
+				t.Error("ParseBytes() succeeded, want the first glob's error")
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		front      string
+		severities []Severity
+	}{
+		{"always", "description: A\nalwaysApply: true", nil},
+		{"auto attached", "description: A\nglobs: *.md", nil},
+		{"agent requested", "description: A", []Severity{SeverityWarning}},
+		{"manual", "", []Severity{SeverityWarning}},
+		{"globs without description", "globs: *.md", []Severity{SeverityError}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule, err := ParseBytes([]byte("---\n" + test.front + "\n---\nBody\n"))
+			if err != nil {
+				t.Fatalf("ParseBytes() error: %v", err)
+			}
+
+			var severities []Severity
+			if err := rule.Validate(); err != nil {
+				validationErr, ok := err.(*ValidationError)
+				if !ok {
+					t.Fatalf("Validate() error = %v, want a *ValidationError", err)
+				}
+				for _, problem := range validationErr.Problems {
+					severities = append(severities, problem.Severity)
+				}
+			}
+			if !reflect.DeepEqual(severities, test.severities) {
+				t.Errorf("Validate() severities = %v, want %v", severities, test.severities)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package patches
+
+import (
+	"concept/pkg/mdc"
+	"concept/pkg/providers"
+	"concept/pkg/verdict"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultDir is where patches are kept, relative to the repository root
+const DefaultDir = ".patches"
+
+// indexFile lists every patch in the store with its metadata
+const indexFile = "index.json"
+
+// Metadata describes how a patch was produced, so that the change can be
+// audited and reproduced
+type Metadata struct {
+	File  string `json:"file"`
+	Patch string `json:"patch"`
+	// The file's last commit when it was reviewed
+	BaseCommit string `json:"base_commit"`
+	// The git blob ids of the reviewed content and the patched content
+	BaseBlob  string `json:"base_blob"`
+	PatchBlob string `json:"patch_blob"`
+	// The file's entry in the git index when it was reviewed
+	Stage     string          `json:"stage,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	Usage     providers.Usage `json:"usage"`
+	// Each request whose changes are part of the patch, in order
+	Changes []Change `json:"changes"`
+}
+
+// Change is a single request whose changes are part of a patch
+type Change struct {
+	// The provider that actually produced the changes, which may be a
+	// fallback rather than the first provider in the chain
+	Provider string          `json:"provider"`
+	Model    string          `json:"model"`
+	Rules    []Rule          `json:"rules"`
+	Usage    providers.Usage `json:"usage"`
+	// A hash of the messages sent to the model
+	PromptHash string `json:"prompt_hash"`
+	// What the model found and why it made the changes
+	Violations []verdict.Violation `json:"violations,omitempty"`
+	Rationale  string              `json:"rationale,omitempty"`
+}
+
+// Rule is a rule applied in a change
+type Rule struct {
+	Path        string `json:"path"`
+	Description string `json:"description"`
+}
+
+// Index is the contents of the patch index
+type Index struct {
+	UpdatedAt time.Time  `json:"updated_at"`
+	Patches   []Metadata `json:"patches"`
+}
+
+// Rules returns the rules applied in a change
+func Rules(rules []mdc.Mdc) []Rule {
+	applied := make([]Rule, len(rules))
+	for i, rule := range rules {
+		applied[i] = Rule{Path: rule.Path, Description: rule.Description}
+	}
+	return applied
+}
+
+// PromptHash returns a hash of the messages sent to the model
+func PromptHash(messages []providers.ProviderMessage) string {
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// Store reads and writes patches and their metadata in a directory
+type Store struct {
+	dir string
+}
+
+// NewStore creates a store for patches in dir
+func NewStore(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// Dir returns the store's directory
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// PatchPath returns where the patch for a file is kept. Files outside the
+// repository, whose patches would escape the store, are rejected.
+func (s *Store) PatchPath(file string) (string, error) {
+	if !filepath.IsLocal(file) {
+		return "", fmt.Errorf("patches: %q is not a path inside the repository", file)
+	}
+
+	path := filepath.Join(s.dir, filepath.Clean(file)+".patch")
+
+	rel, err := filepath.Rel(s.dir, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("patches: %q is not a path inside the repository", file)
+	}
+
+	return path, nil
+}
+
+// Write saves the patch for a file and its metadata, creating any missing
+// directories. The metadata's Patch is set to where the patch was written.
+func (s *Store) Write(file string, patch string, meta *Metadata) error {
+	path, err := s.PatchPath(file)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("patches: failed to create directory for %s: %w", file, err)
+	}
+
+	if err := os.WriteFile(path, []byte(patch), 0644); err != nil {
+		return fmt.Errorf("patches: failed to write patch for %s: %w", file, err)
+	}
+
+	meta.Patch = path
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("patches: failed to encode metadata for %s: %w", file, err)
+	}
+	if err := os.WriteFile(path+".json", data, 0644); err != nil {
+		return fmt.Errorf("patches: failed to write metadata for %s: %w", file, err)
+	}
+
+	return nil
+}
+
+// Remove deletes the patch for a file and its metadata, if there is one
+func (s *Store) Remove(file string) error {
+	path, err := s.PatchPath(file)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range []string{path, path + ".json"} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("patches: failed to remove patch for %s: %w", file, err)
+		}
+	}
+
+	return nil
+}
+
+// Read returns the patch for a file
+func (s *Store) Read(file string) (string, error) {
+	path, err := s.PatchPath(file)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// List returns the path of every patch in the store
+func (s *Store) List() ([]string, error) {
+	var patches []string
+
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path == s.dir {
+				return nil
+			}
+			return err
+		}
+		if !entry.IsDir() && strings.HasSuffix(path, ".patch") {
+			patches = append(patches, path)
+		}
+		return nil
+	})
+
+	return patches, err
+}
+
+// WriteIndex rebuilds the index from the metadata of every patch in the
+// store, including patches from earlier runs for files this run didn't
+// review. Nothing is written if the store
+// doesn't exist.
+func (s *Store) WriteIndex() error {
+	if _, err := os.Stat(s.dir); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	index := Index{
+		UpdatedAt: time.Now().UTC(),
+		Patches:   []Metadata{},
+	}
+
+	patches, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range patches {
+		data, err := os.ReadFile(path + ".json")
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// A patch without metadata can't be indexed
+				continue
+			}
+			return err
+		}
+
+		var meta Metadata
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return fmt.Errorf("patches: failed to read metadata %s.json: %w", path, err)
+		}
+		index.Patches = append(index.Patches, meta)
+	}
+
+	sort.Slice(index.Patches, func(i, j int) bool {
+		return index.Patches[i].File < index.Patches[j].File
+	})
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.dir, indexFile), data, 0644)
+}
+
+// ReadIndex reads the index
+func (s *Store) ReadIndex() (Index, error) {
+	var index Index
+
+	data, err := os.ReadFile(filepath.Join(s.dir, indexFile))
+	if err != nil {
+		return index, err
+	}
+	err = json.Unmarshal(data, &index)
+	return index, err
+}
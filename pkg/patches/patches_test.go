@@ -0,0 +1,93 @@
+package patches
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPatchPath(t *testing.T) {
+	store := NewStore(".patches")
+
+	tests := []struct {
+		file    string
+		want    string
+		invalid bool
+	}{
+		{file: "main.go", want: filepath.Join(".patches", "main.go.patch")},
+		{file: "pkg/git/git.go", want: filepath.Join(".patches", "pkg", "git", "git.go.patch")},
+		{file: "pkg/../main.go", want: filepath.Join(".patches", "main.go.patch")},
+		{file: "../x", invalid: true},
+		{file: "a/../../x", invalid: true},
+		{file: "/etc/passwd", invalid: true},
+		{file: "", invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			got, err := store.PatchPath(test.file)
+			if test.invalid {
+				if err == nil {
+					t.Errorf("PatchPath(%q) = %q, want an error", test.file, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PatchPath(%q) error: %v", test.file, err)
+			}
+			if got != test.want {
+				t.Errorf("PatchPath(%q) = %q, want %q", test.file, got, test.want)
+			}
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), ".patches")
+	store := NewStore(dir)
+
+	var meta Metadata
+	if err := store.Write("pkg/git/git.go", "patch\n", &meta); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+
+	path := filepath.Join(dir, "pkg", "git", "git.go.patch")
+	if meta.Patch != path {
+		t.Errorf("Write() set Patch = %q, want %q", meta.Patch, path)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "patch\n" {
+		t.Errorf("patch file = %q, %v, want %q", data, err, "patch\n")
+	}
+	if _, err := os.Stat(path + ".json"); err != nil {
+		t.Errorf("metadata file: %v", err)
+	}
+
+	got, err := store.Read("pkg/git/git.go")
+	if err != nil || got != "patch\n" {
+		t.Errorf("Read() = %q, %v, want %q", got, err, "patch\n")
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	dir := t.TempDir()
+	store := NewStore(dir)
+
+	// A file where the patch's directory should be
+	if err := os.WriteFile(filepath.Join(dir, "pkg"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := store.Write("pkg/git/git.go", "patch\n", &Metadata{})
+	if err == nil {
+		t.Fatal("Write() succeeded, want an error")
+	}
+	if !strings.Contains(err.Error(), "pkg/git/git.go") {
+		t.Errorf("Write() error = %v, want it to name the file", err)
+	}
+
+	// Other files are still written
+	if err := store.Write("main.go", "patch\n", &Metadata{}); err != nil {
+		t.Errorf("Write() of another file error: %v", err)
+	}
+}
@@ -0,0 +1,305 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	anthropicBaseURL   = "https://api.anthropic.com"
+	anthropicVersion   = "2023-06-01"
+	anthropicModel     = "claude-3-7-sonnet-latest"
+	anthropicMaxTokens = 8192
+)
+
+// AnthropicClient implements the Provider interface for the Anthropic Messages API
+type AnthropicClient struct {
+	httpClient *http.Client
+	baseURL    string
+	apiKey     string
+	model      string
+	maxTokens  int64
+}
+
+// anthropicMessage is a single message in the Anthropic Messages API format
+type anthropicMessage struct {
+	Role    string                  `json:"role"`
+	Content []anthropicContentBlock `json:"content"`
+}
+
+// anthropicContentBlock is a single content block within an anthropicMessage
+type anthropicContentBlock struct {
+	Type string `json:"type"`
+	// Set for "text" blocks
+	Text string `json:"text,omitempty"`
+	// Set for "tool_use" blocks
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+	// Set for "tool_result" blocks
+	ToolUseID string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	InputSchema map[string]any `json:"input_schema"`
+}
+
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	MaxTokens   int64              `json:"max_tokens"`
+	Temperature *float64           `json:"temperature,omitempty"`
+	System      string             `json:"system,omitempty"`
+	Messages    []anthropicMessage `json:"messages"`
+	Tools       []anthropicTool    `json:"tools,omitempty"`
+}
+
+type anthropicResponse struct {
+	ID         string                  `json:"id"`
+	Model      string                  `json:"model"`
+	Role       string                  `json:"role"`
+	Content    []anthropicContentBlock `json:"content"`
+	StopReason string                  `json:"stop_reason"`
+	Usage      struct {
+		InputTokens  int64 `json:"input_tokens"`
+		OutputTokens int64 `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+type anthropicErrorResponse struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// NewAnthropicClient creates a new Anthropic client using ANTHROPIC_API_KEY
+func NewAnthropicClient() (*AnthropicClient, error) {
+	apiKey := os.Getenv("ANTHROPIC_API_KEY")
+	if apiKey == "" {
+		return nil, errors.New("ANTHROPIC_API_KEY is not set")
+	}
+
+	baseURL := os.Getenv("ANTHROPIC_BASE_URL")
+	if baseURL == "" {
+		baseURL = anthropicBaseURL
+	}
+
+	return &AnthropicClient{
+		httpClient: http.DefaultClient,
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		apiKey:     apiKey,
+		model:      anthropicModel,
+		maxTokens:  anthropicMaxTokens,
+	}, nil
+}
+
+// defaultMaxTokens returns the max_tokens sent when the request doesn't set
+// it, which the Messages API requires. It is lowered for models that can't
+// generate that many.
+func (c *AnthropicClient) defaultMaxTokens(model string) int64 {
+	if model == "" {
+		model = c.model
+	}
+	info, _ := LookupModel(model)
+	return info.CapOutputTokens(c.maxTokens)
+}
+
+// ChatCompletion implements the Provider interface for Anthropic. Reasoning
+// effort and response formats have no Messages API equivalent and are
+// ignored, leaving the prompt to describe the reply.
+func (c *AnthropicClient) ChatCompletion(ctx context.Context, request Request) (Response, error) {
+	settings := request.Settings
+	body := anthropicRequest{
+		Model:       c.model,
+		Temperature: settings.Temperature,
+	}
+	if settings.Model != "" {
+		body.Model = settings.Model
+	}
+	body.MaxTokens = c.defaultMaxTokens(body.Model)
+	if settings.MaxTokens > 0 {
+		body.MaxTokens = settings.MaxTokens
+	}
+	for _, tool := range request.Tools {
+		body.Tools = append(body.Tools, anthropicTool{
+			Name:        tool.Name,
+			Description: tool.Description,
+			InputSchema: tool.Parameters,
+		})
+	}
+
+	// The system prompt is a top-level field rather than a message, and
+	// consecutive messages from the same role are merged into one
+	var system []string
+	for _, msg := range request.Messages {
+		if msg.Role == ProviderMessageRoleSystem {
+			system = append(system, msg.Content)
+			continue
+		}
+
+		m := mapAnthropicMessage(msg)
+
+		last := len(body.Messages) - 1
+		if last >= 0 && body.Messages[last].Role == m.Role {
+			body.Messages[last].Content = append(body.Messages[last].Content, m.Content...)
+			continue
+		}
+		body.Messages = append(body.Messages, m)
+	}
+	body.System = strings.Join(system, "\n\n")
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return Response{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/v1/messages", bytes.NewReader(data))
+	if err != nil {
+		return Response{}, err
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("x-api-key", c.apiKey)
+	req.Header.Set("anthropic-version", anthropicVersion)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return Response{}, err
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return Response{}, err
+	}
+
+	if res.StatusCode >= http.StatusBadRequest {
+		apiErr := &APIError{
+			Provider:   "anthropic",
+			StatusCode: res.StatusCode,
+			RetryAfter: parseRetryAfter(res.Header),
+		}
+
+		var errRes anthropicErrorResponse
+		if json.Unmarshal(resBody, &errRes) == nil {
+			apiErr.Type = errRes.Error.Type
+			apiErr.Message = errRes.Error.Message
+		}
+		return Response{}, apiErr
+	}
+
+	var result anthropicResponse
+	if err := json.Unmarshal(resBody, &result); err != nil {
+		return Response{}, fmt.Errorf("anthropic: failed to decode response: %w", err)
+	}
+
+	return Response{
+		Message: unmapAnthropicMessage(anthropicMessage{
+			Role:    result.Role,
+			Content: result.Content,
+		}),
+		FinishReason: anthropicFinishReason(result.StopReason),
+		Model:        result.Model,
+		Usage: Usage{
+			InputTokens:  result.Usage.InputTokens,
+			OutputTokens: result.Usage.OutputTokens,
+		},
+	}, nil
+}
+
+// SummariseMessages implements the Provider interface for Anthropic
+func (c *AnthropicClient) SummariseMessages(ctx context.Context, request Request) (Response, error) {
+	return c.ChatCompletion(ctx, summarise(request))
+}
+
+// DefaultModel implements the Provider interface for Anthropic
+func (c *AnthropicClient) DefaultModel() string {
+	return c.model
+}
+
+func mapAnthropicMessage(message ProviderMessage) anthropicMessage {
+	switch message.Role {
+	case ProviderMessageRoleTool:
+		// Tool results are sent back as user messages holding a tool_result block
+		return anthropicMessage{
+			Role: string(ProviderMessageRoleUser),
+			Content: []anthropicContentBlock{{
+				Type:      "tool_result",
+				ToolUseID: message.ToolCallID,
+				Content:   message.Content,
+			}},
+		}
+	case ProviderMessageRoleAssistant:
+		content := []anthropicContentBlock{}
+		if message.Content != "" {
+			content = append(content, anthropicContentBlock{Type: "text", Text: message.Content})
+		}
+		for _, call := range message.ToolCalls {
+			input := json.RawMessage(call.Arguments)
+			if len(input) == 0 {
+				input = json.RawMessage("{}")
+			}
+			content = append(content, anthropicContentBlock{
+				Type:  "tool_use",
+				ID:    call.ID,
+				Name:  call.Name,
+				Input: input,
+			})
+		}
+		return anthropicMessage{
+			Role:    string(message.Role),
+			Content: content,
+		}
+	default:
+		return anthropicMessage{
+			Role:    string(message.Role),
+			Content: []anthropicContentBlock{{Type: "text", Text: message.Content}},
+		}
+	}
+}
+
+func unmapAnthropicMessage(message anthropicMessage) ProviderMessage {
+	var (
+		text      []string
+		toolCalls []ToolCall
+	)
+
+	for _, block := range message.Content {
+		switch block.Type {
+		case "text":
+			text = append(text, block.Text)
+		case "tool_use":
+			toolCalls = append(toolCalls, ToolCall{
+				ID:        block.ID,
+				Name:      block.Name,
+				Arguments: string(block.Input),
+			})
+		}
+	}
+
+	return ProviderMessage{
+		Content:   strings.Join(text, ""),
+		Role:      ProviderMessageRole(message.Role),
+		ToolCalls: toolCalls,
+	}
+}
+
+func anthropicFinishReason(reason string) FinishReason {
+	switch reason {
+	case "max_tokens":
+		return FinishReasonLength
+	case "tool_use":
+		return FinishReasonToolCalls
+	default:
+		return FinishReasonStop
+	}
+}
@@ -0,0 +1,190 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testClient wraps a single provider in a ProviderClient that retries quickly
+func testClient(name string, provider Provider) *ProviderClient {
+	return &ProviderClient{
+		ProviderName: name,
+		Settings:     ModelSettings{Model: provider.DefaultModel()},
+		Retry:        RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		backends:     []*backend{{name: name, provider: provider}},
+	}
+}
+
+// toolConversation is a review that called two tools, with their results
+var toolConversation = []ProviderMessage{
+	{Role: ProviderMessageRoleSystem, Content: "You review code."},
+	{Role: ProviderMessageRoleSystem, Content: "Follow the rules."},
+	{Role: ProviderMessageRoleUser, Content: "Review a.go"},
+	{Role: ProviderMessageRoleAssistant, ToolCalls: []ToolCall{
+		{ID: "call_1", Name: "read_file", Arguments: `{"path":"a.go"}`},
+		{ID: "call_2", Name: "list_dir", Arguments: ""},
+	}},
+	{Role: ProviderMessageRoleTool, ToolCallID: "call_1", Content: "package a"},
+	{Role: ProviderMessageRoleTool, ToolCallID: "call_2", Content: "a.go"},
+}
+
+func TestAnthropicChatCompletion(t *testing.T) {
+	var (
+		requests int
+		body     anthropicRequest
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/v1/messages" || r.Header.Get("x-api-key") != "key" || r.Header.Get("anthropic-version") != anthropicVersion {
+			t.Errorf("request to %s with headers %v", r.URL.Path, r.Header)
+		}
+
+		// Rate limit the first request
+		if requests == 1 {
+			w.Header().Set("Retry-After-Ms", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			io.WriteString(w, `{"type":"error","error":{"type":"rate_limit_error","message":"slow down"}}`)
+			return
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		io.WriteString(w, `{
+			"id": "msg_1",
+			"model": "claude-3-5-haiku-20241022",
+			"role": "assistant",
+			"content": [
+				{"type": "text", "text": "Checking the rules."},
+				{"type": "tool_use", "id": "call_3", "name": "get_rule", "input": {"name": "style"}}
+			],
+			"stop_reason": "tool_use",
+			"usage": {"input_tokens": 120, "output_tokens": 15}
+		}`)
+	}))
+	defer server.Close()
+
+	client := testClient("anthropic", &AnthropicClient{
+		httpClient: server.Client(),
+		baseURL:    server.URL,
+		apiKey:     "key",
+		model:      "claude-3-5-haiku-latest",
+		maxTokens:  anthropicMaxTokens,
+	})
+
+	completion, err := client.ChatCompletion(context.Background(), Request{Messages: toolConversation})
+	if err != nil {
+		t.Fatalf("ChatCompletion() error: %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("sent %d requests, want the 429 retried once", requests)
+	}
+
+	// The system messages become the system field, and the tool results a
+	// single user message of tool_result blocks
+	if body.System != "You review code.\n\nFollow the rules." {
+		t.Errorf("system = %q", body.System)
+	}
+	if body.Model != "claude-3-5-haiku-latest" || body.MaxTokens != 8192 {
+		t.Errorf("model = %s, max_tokens = %d, want claude-3-5-haiku-latest capped at 8192", body.Model, body.MaxTokens)
+	}
+	if len(body.Messages) != 3 {
+		t.Fatalf("messages = %+v, want user, assistant and user", body.Messages)
+	}
+
+	user, assistant, results := body.Messages[0], body.Messages[1], body.Messages[2]
+	if user.Role != "user" || len(user.Content) != 1 || user.Content[0].Type != "text" || user.Content[0].Text != "Review a.go" {
+		t.Errorf("first message = %+v", user)
+	}
+	if assistant.Role != "assistant" || len(assistant.Content) != 2 {
+		t.Fatalf("second message = %+v, want two tool_use blocks", assistant)
+	}
+	for i, want := range []anthropicContentBlock{
+		{Type: "tool_use", ID: "call_1", Name: "read_file", Input: json.RawMessage(`{"path":"a.go"}`)},
+		{Type: "tool_use", ID: "call_2", Name: "list_dir", Input: json.RawMessage(`{}`)},
+	} {
+		got := assistant.Content[i]
+		if got.Type != want.Type || got.ID != want.ID || got.Name != want.Name || string(got.Input) != string(want.Input) {
+			t.Errorf("tool_use block %d = %+v, want %+v", i, got, want)
+		}
+	}
+	if results.Role != "user" || len(results.Content) != 2 {
+		t.Fatalf("third message = %+v, want two tool_result blocks", results)
+	}
+	for i, want := range []anthropicContentBlock{
+		{Type: "tool_result", ToolUseID: "call_1", Content: "package a"},
+		{Type: "tool_result", ToolUseID: "call_2", Content: "a.go"},
+	} {
+		if got := results.Content[i]; got.Type != want.Type || got.ToolUseID != want.ToolUseID || got.Content != want.Content {
+			t.Errorf("tool_result block %d = %+v, want %+v", i, got, want)
+		}
+	}
+
+	if completion.Provider != "anthropic" || completion.Model != "claude-3-5-haiku-20241022" {
+		t.Errorf("completion from %s/%s", completion.Provider, completion.Model)
+	}
+	if completion.FinishReason != FinishReasonToolCalls {
+		t.Errorf("finish reason = %s, want %s", completion.FinishReason, FinishReasonToolCalls)
+	}
+	if completion.Message.Content != "Checking the rules." || len(completion.Message.ToolCalls) != 1 {
+		t.Fatalf("message = %+v", completion.Message)
+	}
+	if call := completion.Message.ToolCalls[0]; call != (ToolCall{ID: "call_3", Name: "get_rule", Arguments: `{"name": "style"}`}) {
+		t.Errorf("tool call = %+v", call)
+	}
+	if completion.Usage != (Usage{InputTokens: 120, OutputTokens: 15}) {
+		t.Errorf("usage = %+v", completion.Usage)
+	}
+}
+
+func TestAnthropicError(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"type":"error","error":{"type":"invalid_request_error","message":"prompt is too long"}}`)
+	}))
+	defer server.Close()
+
+	client := testClient("anthropic", &AnthropicClient{
+		httpClient: server.Client(),
+		baseURL:    server.URL,
+		apiKey:     "key",
+		model:      anthropicModel,
+		maxTokens:  anthropicMaxTokens,
+	})
+
+	_, err := client.ChatCompletion(context.Background(), Request{Messages: toolConversation[:3]})
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("ChatCompletion() error = %v, want an *APIError", err)
+	}
+	if apiErr.StatusCode != http.StatusBadRequest || apiErr.Type != "invalid_request_error" || apiErr.Message != "prompt is too long" {
+		t.Errorf("error = %+v", apiErr)
+	}
+	if requests != 1 {
+		t.Errorf("sent %d requests, want a bad request not retried", requests)
+	}
+}
+
+func TestAnthropicFinishReason(t *testing.T) {
+	tests := map[string]FinishReason{
+		"end_turn":      FinishReasonStop,
+		"stop_sequence": FinishReasonStop,
+		"max_tokens":    FinishReasonLength,
+		"tool_use":      FinishReasonToolCalls,
+	}
+
+	for reason, want := range tests {
+		if got := anthropicFinishReason(reason); got != want {
+			t.Errorf("anthropicFinishReason(%q) = %s, want %s", reason, got, want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package providers
+
+import (
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Budget caps the tokens or dollars spent across a run. Spend is recorded
+// from the usage reported by each response, so requests already in flight
+// when the budget runs out still complete and are counted.
+type Budget struct {
+	// The most input and output tokens to spend, or 0 for no limit
+	MaxTokens int64
+	// The most US dollars to spend, or 0 for no limit
+	MaxCost float64
+	// Prices in US dollars per million tokens that replace every model's
+	// known price, or nil to use the known prices
+	InputPrice  *float64
+	OutputPrice *float64
+
+	mu     sync.Mutex
+	tokens int64
+	cost   float64
+	// Models already warned about having no price
+	unpriced map[string]bool
+}
+
+// NewBudget creates a Budget with the given limits
+func NewBudget(maxTokens int64, maxCost float64) *Budget {
+	return &Budget{
+		MaxTokens: maxTokens,
+		MaxCost:   maxCost,
+	}
+}
+
+// Record adds the usage of a response from the given model to the amount
+// spent
+func (b *Budget) Record(model string, usage Usage) {
+	info, ok := LookupModel(model)
+	if b.InputPrice != nil {
+		info.InputPrice = *b.InputPrice
+	}
+	if b.OutputPrice != nil {
+		info.OutputPrice = *b.OutputPrice
+	}
+	priced := ok || (b.InputPrice != nil && b.OutputPrice != nil)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Spend on a model without a price can't count towards a dollar limit
+	if !priced && b.MaxCost > 0 && !b.unpriced[model] {
+		if b.unpriced == nil {
+			b.unpriced = map[string]bool{}
+		}
+		b.unpriced[model] = true
+		log.Warn().Str("model", model).Msg("No price known for model, its spend doesn't count towards the dollar budget")
+	}
+
+	b.tokens += usage.InputTokens + usage.OutputTokens
+	b.cost += info.Cost(int(usage.InputTokens), int(usage.OutputTokens))
+}
+
+// Spent returns the tokens and US dollars spent so far
+func (b *Budget) Spent() (tokens int64, cost float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.tokens, b.cost
+}
+
+// Exhausted reports whether either limit has been reached
+func (b *Budget) Exhausted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return (b.MaxTokens > 0 && b.tokens >= b.MaxTokens) ||
+		(b.MaxCost > 0 && b.cost >= b.MaxCost)
+}
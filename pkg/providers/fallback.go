@@ -0,0 +1,84 @@
+package providers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// A provider is marked unhealthy after this many requests in a row fail,
+// even after retries, and is only tried after every healthy provider until
+// the cooldown has passed
+const (
+	unhealthyAfter    = 3
+	unhealthyCooldown = 5 * time.Minute
+)
+
+// backend is a single provider in a ProviderClient's fallback chain
+type backend struct {
+	name     string
+	provider Provider
+	limiter  *Limiter
+	budget   *Budget
+
+	mu             sync.Mutex
+	failures       int
+	unhealthyUntil time.Time
+}
+
+// withinBudget reports whether the provider has budget left
+func (b *backend) withinBudget() bool {
+	return b.budget == nil || !b.budget.Exhausted()
+}
+
+// healthy reports whether the provider is outside any unhealthy cooldown
+func (b *backend) healthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return time.Now().After(b.unhealthyUntil)
+}
+
+// success records a successful request, restoring the provider's health
+func (b *backend) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+}
+
+// failure records a failed request, marking the provider unhealthy once
+// too many have failed in a row
+func (b *backend) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.failures >= unhealthyAfter {
+		b.unhealthyUntil = time.Now().Add(unhealthyCooldown)
+		b.failures = 0
+		log.Warn().
+			Str("provider", b.name).
+			Dur("cooldown", unhealthyCooldown).
+			Msg("Provider marked unhealthy")
+	}
+}
+
+// candidates returns the providers to try, in order: the healthy ones within
+// budget first, then the unhealthy ones within budget as a last resort
+func candidates(backends []*backend) []*backend {
+	var healthy, unhealthy []*backend
+	for _, b := range backends {
+		if !b.withinBudget() {
+			log.Debug().Str("provider", b.name).Msg("Skipping provider over budget")
+			continue
+		}
+		if b.healthy() {
+			healthy = append(healthy, b)
+		} else {
+			unhealthy = append(unhealthy, b)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
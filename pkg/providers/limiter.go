@@ -0,0 +1,201 @@
+package providers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Limits configures a Limiter. Zero values mean no limit.
+type Limits struct {
+	// The maximum number of requests started per minute
+	RequestsPerMinute int
+	// The maximum number of tokens sent per minute
+	TokensPerMinute int
+	// The most requests allowed in flight at once
+	MaxConcurrency int
+}
+
+// Outcome is how a request holding a Limiter's capacity ended
+type Outcome int
+
+const (
+	// OutcomeSuccess is a request the provider answered
+	OutcomeSuccess Outcome = iota
+	// OutcomeRateLimited is a request the provider rejected for exceeding a
+	// rate limit
+	OutcomeRateLimited
+	// OutcomeError is a request that failed for any other reason, which says
+	// nothing about the provider's rate limits
+	OutcomeError
+)
+
+// Limiter is shared by every worker calling a provider. It enforces request
+// and token budgets per minute, and adapts how many requests may be in flight:
+// halving it on every rate-limit response and adding one back after each run
+// of successful requests.
+type Limiter struct {
+	mu     sync.Mutex
+	limits Limits
+
+	requests *bucket
+	tokens   *bucket
+
+	concurrency int
+	inFlight    int
+	successes   int
+
+	// closed and replaced whenever capacity is released
+	changed chan struct{}
+}
+
+// bucket is a token bucket refilled continuously up to its capacity
+type bucket struct {
+	capacity float64
+	level    float64
+	perSec   float64
+	updated  time.Time
+}
+
+func newBucket(perMinute int) *bucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &bucket{
+		capacity: float64(perMinute),
+		level:    float64(perMinute),
+		perSec:   float64(perMinute) / 60,
+		updated:  time.Now(),
+	}
+}
+
+// wait refills the bucket and returns how long until n can be taken from it.
+// Requests larger than the bucket wait for it to be full.
+func (b *bucket) wait(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.level += now.Sub(b.updated).Seconds() * b.perSec
+	if b.level > b.capacity {
+		b.level = b.capacity
+	}
+	b.updated = now
+
+	if n > b.capacity {
+		n = b.capacity
+	}
+	if b.level >= n {
+		return 0
+	}
+	return time.Duration((n - b.level) / b.perSec * float64(time.Second))
+}
+
+func (b *bucket) take(n float64) {
+	if b == nil {
+		return
+	}
+	if n > b.capacity {
+		n = b.capacity
+	}
+	b.level -= n
+}
+
+// NewLimiter creates a Limiter enforcing the given limits
+func NewLimiter(limits Limits) *Limiter {
+	return &Limiter{
+		limits:      limits,
+		requests:    newBucket(limits.RequestsPerMinute),
+		tokens:      newBucket(limits.TokensPerMinute),
+		concurrency: limits.MaxConcurrency,
+		changed:     make(chan struct{}),
+	}
+}
+
+// Acquire blocks until a request of the given number of tokens fits within
+// the limits, or the context is done. Every successful Acquire must be paired
+// with a Release.
+func (l *Limiter) Acquire(ctx context.Context, tokens int) error {
+	for {
+		l.mu.Lock()
+
+		var delay time.Duration
+		blocked := l.limits.MaxConcurrency > 0 && l.inFlight >= l.concurrency
+		if !blocked {
+			now := time.Now()
+			delay = l.requests.wait(1, now)
+			if d := l.tokens.wait(float64(tokens), now); d > delay {
+				delay = d
+			}
+
+			if delay == 0 {
+				l.requests.take(1)
+				l.tokens.take(float64(tokens))
+				l.inFlight++
+				l.mu.Unlock()
+				return nil
+			}
+		}
+
+		changed := l.changed
+		l.mu.Unlock()
+
+		var (
+			timer   *time.Timer
+			timeout <-chan time.Time
+		)
+		if delay > 0 {
+			timer = time.NewTimer(delay)
+			timeout = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			err := ctx.Err()
+			if timer != nil {
+				timer.Stop()
+			}
+			return err
+		case <-changed:
+		case <-timeout:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Release frees the capacity held by a request. Only successful requests count
+// towards raising the concurrency again.
+func (l *Limiter) Release(outcome Outcome) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+
+	if l.limits.MaxConcurrency > 0 {
+		switch outcome {
+		case OutcomeRateLimited:
+			if l.concurrency > 1 {
+				l.concurrency /= 2
+				log.Info().Int("concurrency", l.concurrency).Msg("Rate limited, reducing concurrency")
+			}
+			l.successes = 0
+		case OutcomeSuccess:
+			if l.concurrency < l.limits.MaxConcurrency {
+				l.successes++
+				if l.successes >= l.concurrency {
+					l.concurrency++
+					l.successes = 0
+					log.Debug().Int("concurrency", l.concurrency).Msg("Increasing concurrency")
+				}
+			}
+		}
+	}
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
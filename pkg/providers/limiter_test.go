@@ -0,0 +1,150 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiterConcurrency(t *testing.T) {
+	limiter := NewLimiter(Limits{MaxConcurrency: 8})
+
+	// release acquires and releases a single request
+	release := func(outcome Outcome) {
+		t.Helper()
+		if err := limiter.Acquire(context.Background(), 0); err != nil {
+			t.Fatalf("Acquire() error: %v", err)
+		}
+		limiter.Release(outcome)
+	}
+
+	// Every rate limit halves the concurrency, down to one
+	for _, want := range []int{4, 2, 1, 1} {
+		release(OutcomeRateLimited)
+		if limiter.concurrency != want {
+			t.Fatalf("concurrency after a rate limit = %d, want %d", limiter.concurrency, want)
+		}
+	}
+
+	// Other errors leave it alone
+	release(OutcomeError)
+	if limiter.concurrency != 1 {
+		t.Fatalf("concurrency after an error = %d, want 1", limiter.concurrency)
+	}
+
+	// A run of as many successes as the concurrency adds one back, up to the
+	// maximum
+	for want := 2; want <= 8; want++ {
+		for i := 0; i < want-1; i++ {
+			release(OutcomeSuccess)
+		}
+		if limiter.concurrency != want {
+			t.Fatalf("concurrency after %d successes = %d, want %d", want-1, limiter.concurrency, want)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		release(OutcomeSuccess)
+	}
+	if limiter.concurrency != 8 {
+		t.Errorf("concurrency = %d, want it to stay at the maximum of 8", limiter.concurrency)
+	}
+
+	// A rate limit also starts the run of successes again
+	release(OutcomeRateLimited)
+	release(OutcomeSuccess)
+	release(OutcomeSuccess)
+	release(OutcomeSuccess)
+	release(OutcomeRateLimited)
+	if limiter.concurrency != 2 || limiter.successes != 0 {
+		t.Errorf("concurrency = %d with %d successes, want 2 with none", limiter.concurrency, limiter.successes)
+	}
+}
+
+func TestLimiterBlocksInFlight(t *testing.T) {
+	limiter := NewLimiter(Limits{MaxConcurrency: 1})
+
+	if err := limiter.Acquire(context.Background(), 0); err != nil {
+		t.Fatalf("Acquire() error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := limiter.Acquire(ctx, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Acquire() over the concurrency = %v, want it to block until the deadline", err)
+	}
+
+	// Releasing wakes up a waiting request
+	acquired := make(chan error)
+	go func() {
+		acquired <- limiter.Acquire(context.Background(), 0)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	limiter.Release(OutcomeSuccess)
+
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Errorf("Acquire() after Release() error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Acquire() still blocked after Release()")
+	}
+}
+
+func TestLimiterBlocksTokens(t *testing.T) {
+	limiter := NewLimiter(Limits{TokensPerMinute: 600})
+
+	if err := limiter.Acquire(context.Background(), 600); err != nil {
+		t.Fatalf("Acquire() error: %v", err)
+	}
+	limiter.Release(OutcomeSuccess)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := limiter.Acquire(ctx, 600); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Acquire() past the tokens per minute = %v, want it to wait for the bucket to refill", err)
+	}
+}
+
+func TestBucketWait(t *testing.T) {
+	if got := (*bucket)(nil).wait(100, time.Now()); got != 0 {
+		t.Errorf("nil bucket wait() = %v, want no wait", got)
+	}
+	if newBucket(0) != nil {
+		t.Error("newBucket(0) is not nil, want no limit")
+	}
+
+	// One per second
+	b := newBucket(60)
+	start := b.updated
+
+	tests := []struct {
+		name string
+		n    float64
+		at   time.Duration
+		take bool
+		want time.Duration
+	}{
+		{name: "full", n: 60, take: true, want: 0},
+		{name: "empty", n: 1, want: time.Second},
+		{name: "refilling", n: 1, at: 500 * time.Millisecond, want: 500 * time.Millisecond},
+		{name: "more than the capacity waits for a full bucket", n: 120, at: 500 * time.Millisecond, want: 59500 * time.Millisecond},
+		{name: "refilled", n: 10, at: 10 * time.Second, take: true, want: 0},
+		{name: "after taking", n: 1, at: 10 * time.Second, want: time.Second},
+		{name: "never above the capacity", n: 60, at: time.Hour, want: 0},
+	}
+
+	for _, test := range tests {
+		got := b.wait(test.n, start.Add(test.at))
+		if got != test.want {
+			t.Errorf("%s: wait(%v) = %v, want %v", test.name, test.n, got, test.want)
+		}
+		if test.take {
+			b.take(test.n)
+		}
+	}
+	if b.level != 60 {
+		t.Errorf("level = %v, want the capacity of 60", b.level)
+	}
+}
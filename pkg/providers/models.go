@@ -0,0 +1,119 @@
+package providers
+
+import (
+	"strings"
+
+	"github.com/openai/openai-go"
+)
+
+// ModelInfo describes the limits and pricing of a model
+type ModelInfo struct {
+	// The number of tokens the model can take as input and output combined
+	ContextWindow int
+	// The most tokens the model can generate in one response, or 0 if
+	// unknown
+	MaxOutputTokens int64
+	// US dollars per million input tokens
+	InputPrice float64
+	// US dollars per million output tokens
+	OutputPrice float64
+}
+
+// Cost returns the price in US dollars of a request with the given usage
+func (m ModelInfo) Cost(inputTokens int, outputTokens int) float64 {
+	return (float64(inputTokens)*m.InputPrice + float64(outputTokens)*m.OutputPrice) / 1_000_000
+}
+
+// CapOutputTokens returns maxTokens, lowered to the most the model can
+// generate if that is known
+func (m ModelInfo) CapOutputTokens(maxTokens int64) int64 {
+	if m.MaxOutputTokens > 0 && maxTokens > m.MaxOutputTokens {
+		return m.MaxOutputTokens
+	}
+	return maxTokens
+}
+
+// DefaultContextWindow is assumed for models missing from the table below
+const DefaultContextWindow = 8192
+
+// models lists known models by name prefix, so dated snapshots such as
+// gpt-4o-2024-08-06 match their family
+var models = map[string]ModelInfo{
+	"o1":                {ContextWindow: 200000, MaxOutputTokens: 100000, InputPrice: 15, OutputPrice: 60},
+	"o1-mini":           {ContextWindow: 128000, MaxOutputTokens: 65536, InputPrice: 1.10, OutputPrice: 4.40},
+	"o3-mini":           {ContextWindow: 200000, MaxOutputTokens: 100000, InputPrice: 1.10, OutputPrice: 4.40},
+	"gpt-4o":            {ContextWindow: 128000, MaxOutputTokens: 16384, InputPrice: 2.50, OutputPrice: 10},
+	"gpt-4o-mini":       {ContextWindow: 128000, MaxOutputTokens: 16384, InputPrice: 0.15, OutputPrice: 0.60},
+	"gpt-4-turbo":       {ContextWindow: 128000, MaxOutputTokens: 4096, InputPrice: 10, OutputPrice: 30},
+	"gpt-3.5-turbo":     {ContextWindow: 16385, MaxOutputTokens: 4096, InputPrice: 0.50, OutputPrice: 1.50},
+	"claude-3-7-sonnet": {ContextWindow: 200000, MaxOutputTokens: 64000, InputPrice: 3, OutputPrice: 15},
+	"claude-3-5-sonnet": {ContextWindow: 200000, MaxOutputTokens: 8192, InputPrice: 3, OutputPrice: 15},
+	"claude-3-5-haiku":  {ContextWindow: 200000, MaxOutputTokens: 8192, InputPrice: 0.80, OutputPrice: 4},
+	"claude-3-opus":     {ContextWindow: 200000, MaxOutputTokens: 4096, InputPrice: 15, OutputPrice: 75},
+	"claude-3-haiku":    {ContextWindow: 200000, MaxOutputTokens: 4096, InputPrice: 0.25, OutputPrice: 1.25},
+}
+
+// LookupModel returns what is known about a model, matching the longest
+// known name prefix. Unknown models get the default context window and no
+// price, and ok is false.
+func LookupModel(model string) (info ModelInfo, ok bool) {
+	var match string
+	info = ModelInfo{ContextWindow: DefaultContextWindow}
+
+	for name, m := range models {
+		if strings.HasPrefix(model, name) && len(name) > len(match) {
+			match = name
+			info = m
+		}
+	}
+
+	return info, match != ""
+}
+
+// DefaultModel returns the model a provider uses when none is chosen,
+// without needing to create a client or hold an API key. For a fallback
+// chain this is the first provider's model.
+func DefaultModel(providerName string) string {
+	providerName, _, _ = strings.Cut(providerName, ",")
+
+	switch strings.TrimSpace(providerName) {
+	case "openai":
+		return string(openai.ChatModelO1)
+	case "openai-compatible", "local":
+		return OpenAICompatibleConfigFromEnv().Model
+	case "anthropic":
+		return anthropicModel
+	case "replay":
+		config := ReplayConfigFromEnv()
+		if config.Mode == ReplayModeRecord {
+			return DefaultModel(config.Provider)
+		}
+		recorded, _ := readRecording(config)
+		return recorded.Model
+	default:
+		return ""
+	}
+}
+
+// SmallModel returns a small, cheap model of a provider for simple choices
+// such as which rules apply to a file, or "" where there is none, such as
+// for local servers, and the default model should be used
+func SmallModel(providerName string) string {
+	providerName, _, _ = strings.Cut(providerName, ",")
+
+	switch strings.TrimSpace(providerName) {
+	case "openai":
+		return string(openai.ChatModelGPT4oMini)
+	case "anthropic":
+		return "claude-3-5-haiku-latest"
+	case "replay":
+		config := ReplayConfigFromEnv()
+		if config.Mode == ReplayModeRecord {
+			return SmallModel(config.Provider)
+		}
+		recorded, _ := readRecording(config)
+		return SmallModel(recorded.Provider)
+	default:
+		return ""
+	}
+}
@@ -2,71 +2,247 @@ package providers
 
 import (
 	"context"
+	"errors"
+	"os"
+	"strings"
 
 	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+	"github.com/openai/openai-go/shared"
 )
 
-// OpenAIClient implements the Provider interface for OpenAI
+// OpenAIClient implements the Provider interface for OpenAI and any server
+// exposing an OpenAI-compatible chat completions endpoint
 type OpenAIClient struct {
 	client *openai.Client
+	model  openai.ChatModel
+	// Send max_tokens rather than max_completion_tokens, which most
+	// OpenAI-compatible servers don't understand yet
+	legacyMaxTokens bool
+	// Ask for any JSON object rather than one following a schema, as most
+	// OpenAI-compatible servers don't support structured outputs
+	jsonObjectOnly bool
+}
+
+// OpenAIConfig configures an OpenAI-compatible endpoint
+type OpenAIConfig struct {
+	// The base URL of the API, e.g. http://localhost:11434/v1
+	BaseURL string
+	// The model to request completions from
+	Model string
+	// The API key, or empty if the endpoint needs no authentication
+	APIKey string
+	// The header carrying the API key. Defaults to Authorization, which sends
+	// the key as a bearer token; any other header receives the key verbatim
+	AuthHeader string
 }
 
 // NewOpenAIClient creates a new OpenAI client
 func NewOpenAIClient() (*OpenAIClient, error) {
-	client := openai.NewClient()
-	// TODO: Implement proper configuration loading
+	// Retries are handled by the ProviderClient
+	client := openai.NewClient(option.WithMaxRetries(0))
 	return &OpenAIClient{
 		client: client,
+		model:  openai.ChatModel(DefaultModel("openai")),
 	}, nil
 }
 
-// ChatCompletion implements the Provider interface for OpenAI
-func (c *OpenAIClient) ChatCompletion(ctx context.Context, messages []any) (any, error) {
-	// Type assert the messages to OpenAI's expected type
-	openaiMessages := make([]openai.ChatCompletionMessageParamUnion, len(messages))
-	for i, msg := range messages {
-		if m, ok := msg.(openai.ChatCompletionMessageParamUnion); ok {
-			openaiMessages[i] = m
+// NewOpenAICompatibleClient creates a client for an OpenAI-compatible endpoint
+// such as Ollama, llama.cpp or vLLM
+func NewOpenAICompatibleClient(config OpenAIConfig) (*OpenAIClient, error) {
+	if config.BaseURL == "" {
+		return nil, errors.New("openai-compatible: base URL is required")
+	}
+	if config.Model == "" {
+		return nil, errors.New("openai-compatible: model is required")
+	}
+
+	// Always drop the default authorization header so that OPENAI_API_KEY is
+	// never sent to a third-party endpoint
+	opts := []option.RequestOption{
+		option.WithBaseURL(strings.TrimRight(config.BaseURL, "/") + "/"),
+		option.WithHeaderDel("authorization"),
+		option.WithMaxRetries(0),
+	}
+
+	if config.APIKey != "" {
+		if config.AuthHeader == "" || strings.EqualFold(config.AuthHeader, "authorization") {
+			opts = append(opts, option.WithAPIKey(config.APIKey))
+		} else {
+			opts = append(opts, option.WithHeader(config.AuthHeader, config.APIKey))
 		}
 	}
 
-	result, err := c.client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
-		Model:    openai.F(openai.ChatModelO1),
+	return &OpenAIClient{
+		client:          openai.NewClient(opts...),
+		model:           openai.ChatModel(config.Model),
+		legacyMaxTokens: true,
+		jsonObjectOnly:  true,
+	}, nil
+}
+
+// OpenAICompatibleConfigFromEnv reads an OpenAIConfig from the
+// OPENAI_COMPATIBLE_* environment variables
+func OpenAICompatibleConfigFromEnv() OpenAIConfig {
+	return OpenAIConfig{
+		BaseURL:    os.Getenv("OPENAI_COMPATIBLE_BASE_URL"),
+		Model:      os.Getenv("OPENAI_COMPATIBLE_MODEL"),
+		APIKey:     os.Getenv("OPENAI_COMPATIBLE_API_KEY"),
+		AuthHeader: os.Getenv("OPENAI_COMPATIBLE_AUTH_HEADER"),
+	}
+}
+
+// ChatCompletion implements the Provider interface for OpenAI
+func (c *OpenAIClient) ChatCompletion(ctx context.Context, request Request) (Response, error) {
+	openaiMessages := make([]openai.ChatCompletionMessageParamUnion, len(request.Messages))
+	for i, msg := range request.Messages {
+		openaiMessages[i] = mapOpenAIMessage(msg)
+	}
+
+	settings := request.Settings
+	params := openai.ChatCompletionNewParams{
+		Model:    openai.F(c.model),
 		Messages: openai.F(openaiMessages),
-	})
+	}
+	if settings.Model != "" {
+		params.Model = openai.F(openai.ChatModel(settings.Model))
+	}
+	if settings.Temperature != nil {
+		params.Temperature = openai.F(*settings.Temperature)
+	}
+	if settings.MaxTokens > 0 {
+		if c.legacyMaxTokens {
+			params.MaxTokens = openai.F(settings.MaxTokens)
+		} else {
+			params.MaxCompletionTokens = openai.F(settings.MaxTokens)
+		}
+	}
+	if settings.ReasoningEffort != "" {
+		params.ReasoningEffort = openai.F(openai.ChatCompletionReasoningEffort(settings.ReasoningEffort))
+	}
+	if len(request.Tools) > 0 {
+		tools := make([]openai.ChatCompletionToolParam, len(request.Tools))
+		for i, tool := range request.Tools {
+			tools[i] = openai.ChatCompletionToolParam{
+				Type: openai.F(openai.ChatCompletionToolTypeFunction),
+				Function: openai.F(shared.FunctionDefinitionParam{
+					Name:        openai.F(tool.Name),
+					Description: openai.F(tool.Description),
+					Parameters:  openai.F(shared.FunctionParameters(tool.Parameters)),
+				}),
+			}
+		}
+		params.Tools = openai.F(tools)
+	}
+	if request.ResponseFormat != nil {
+		if c.jsonObjectOnly {
+			params.ResponseFormat = openai.F[openai.ChatCompletionNewParamsResponseFormatUnion](shared.ResponseFormatJSONObjectParam{
+				Type: openai.F(shared.ResponseFormatJSONObjectTypeJSONObject),
+			})
+		} else {
+			params.ResponseFormat = openai.F[openai.ChatCompletionNewParamsResponseFormatUnion](shared.ResponseFormatJSONSchemaParam{
+				Type: openai.F(shared.ResponseFormatJSONSchemaTypeJSONSchema),
+				JSONSchema: openai.F(shared.ResponseFormatJSONSchemaJSONSchemaParam{
+					Name:   openai.F(request.ResponseFormat.Name),
+					Schema: openai.F[interface{}](request.ResponseFormat.Schema),
+					Strict: openai.F(true),
+				}),
+			})
+		}
+	}
+
+	result, err := c.client.Chat.Completions.New(ctx, params)
 	if err != nil {
-		return nil, err
+		return Response{}, err
+	}
+
+	response := Response{
+		Model: result.Model,
+		Usage: Usage{
+			InputTokens:  result.Usage.PromptTokens,
+			OutputTokens: result.Usage.CompletionTokens,
+		},
 	}
 
-	return result.Choices[0].Message, nil
+	if len(result.Choices) == 0 {
+		return response, errors.New("openai: response contained no choices")
+	}
+
+	response.Message = unmapOpenAIMessage(result.Choices[0].Message)
+	response.FinishReason = openAIFinishReason(result.Choices[0].FinishReason)
+
+	return response, nil
 }
 
 // SummariseMessages implements the Provider interface for OpenAI
-func (c *OpenAIClient) SummariseMessages(messages []any) (any, error) {
-	// Type assert the messages to OpenAI's expected type
-	openaiMessages := make([]openai.ChatCompletionMessageParamUnion, len(messages))
-	for i, msg := range messages {
-		if m, ok := msg.(openai.ChatCompletionMessageParamUnion); ok {
-			openaiMessages[i] = m
+func (c *OpenAIClient) SummariseMessages(ctx context.Context, request Request) (Response, error) {
+	return c.ChatCompletion(ctx, summarise(request))
+}
+
+// DefaultModel implements the Provider interface for OpenAI
+func (c *OpenAIClient) DefaultModel() string {
+	return string(c.model)
+}
+
+// mapOpenAIMessage maps a message to OpenAI's generic message param, which
+// sends content as a plain string for the widest server compatibility
+func mapOpenAIMessage(message ProviderMessage) openai.ChatCompletionMessageParamUnion {
+	param := openai.ChatCompletionMessageParam{
+		Role: openai.F(openai.ChatCompletionMessageParamRole(message.Role)),
+	}
+
+	if message.Content != "" || len(message.ToolCalls) == 0 {
+		param.Content = openai.F[any](message.Content)
+	}
+
+	if message.ToolCallID != "" {
+		param.ToolCallID = openai.F(message.ToolCallID)
+	}
+
+	if len(message.ToolCalls) > 0 {
+		toolCalls := make([]openai.ChatCompletionMessageToolCallParam, len(message.ToolCalls))
+		for i, call := range message.ToolCalls {
+			toolCalls[i] = openai.ChatCompletionMessageToolCallParam{
+				ID:   openai.F(call.ID),
+				Type: openai.F(openai.ChatCompletionMessageToolCallTypeFunction),
+				Function: openai.F(openai.ChatCompletionMessageToolCallFunctionParam{
+					Name:      openai.F(call.Name),
+					Arguments: openai.F(call.Arguments),
+				}),
+			}
 		}
+		param.ToolCalls = openai.F[any](toolCalls)
 	}
 
-	// TODO: Implement OpenAI message summarisation
-	return openai.ChatCompletionMessage{}, nil
+	return param
 }
 
-func MapOpenAIProviderMessage(message ProviderMessage) openai.ChatCompletionMessageParamUnion {
-	return openai.ChatCompletionMessage{
-		Content:   message.Content,
-		Role:      openai.ChatCompletionMessageRole(message.Role),
-		ToolCalls: message.ToolCalls,
+func unmapOpenAIMessage(message openai.ChatCompletionMessage) ProviderMessage {
+	var toolCalls []ToolCall
+	for _, call := range message.ToolCalls {
+		toolCalls = append(toolCalls, ToolCall{
+			ID:        call.ID,
+			Name:      call.Function.Name,
+			Arguments: call.Function.Arguments,
+		})
 	}
-}
 
-func UnmapOpenAIProviderMessage(message openai.ChatCompletionMessage) ProviderMessage {
 	return ProviderMessage{
 		Content:   message.Content,
 		Role:      ProviderMessageRole(message.Role),
-		ToolCalls: message.ToolCalls,
+		ToolCalls: toolCalls,
+	}
+}
+
+func openAIFinishReason(reason openai.ChatCompletionChoicesFinishReason) FinishReason {
+	switch reason {
+	case openai.ChatCompletionChoicesFinishReasonLength:
+		return FinishReasonLength
+	case openai.ChatCompletionChoicesFinishReasonToolCalls, openai.ChatCompletionChoicesFinishReasonFunctionCall:
+		return FinishReasonToolCalls
+	case openai.ChatCompletionChoicesFinishReasonContentFilter:
+		return FinishReasonContentFilter
+	default:
+		return FinishReasonStop
 	}
 }
@@ -0,0 +1,160 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/openai/openai-go"
+)
+
+// openAIRequest is the part of a chat completions request the tests check
+type openAIRequest struct {
+	Model     string `json:"model"`
+	MaxTokens int64  `json:"max_tokens"`
+	Messages  []struct {
+		Role       string `json:"role"`
+		Content    string `json:"content"`
+		ToolCallID string `json:"tool_call_id"`
+		ToolCalls  []struct {
+			ID       string `json:"id"`
+			Type     string `json:"type"`
+			Function struct {
+				Name      string `json:"name"`
+				Arguments string `json:"arguments"`
+			} `json:"function"`
+		} `json:"tool_calls"`
+	} `json:"messages"`
+	ResponseFormat struct {
+		Type string `json:"type"`
+	} `json:"response_format"`
+}
+
+func TestOpenAICompatibleChatCompletion(t *testing.T) {
+	// Must never reach a third-party endpoint
+	t.Setenv("OPENAI_API_KEY", "openai-secret")
+
+	var (
+		requests int
+		body     openAIRequest
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("request to %s", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			t.Errorf("Authorization = %q, want none", auth)
+		}
+		if key := r.Header.Get("X-Api-Key"); key != "local-key" {
+			t.Errorf("X-Api-Key = %q, want local-key", key)
+		}
+
+		// Rate limit the first request
+		if requests == 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After-Ms", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			io.WriteString(w, `{"error":{"message":"slow down","type":"rate_limit"}}`)
+			return
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{
+			"id": "chatcmpl-1",
+			"object": "chat.completion",
+			"created": 1700000000,
+			"model": "qwen2.5-coder",
+			"choices": [{
+				"index": 0,
+				"message": {
+					"role": "assistant",
+					"content": "",
+					"tool_calls": [{"id": "call_3", "type": "function", "function": {"name": "get_rule", "arguments": "{\"name\":\"style\"}"}}]
+				},
+				"finish_reason": "tool_calls"
+			}],
+			"usage": {"prompt_tokens": 120, "completion_tokens": 15, "total_tokens": 135}
+		}`)
+	}))
+	defer server.Close()
+
+	provider, err := NewOpenAICompatibleClient(OpenAIConfig{
+		BaseURL:    server.URL + "/v1",
+		Model:      "qwen2.5-coder",
+		APIKey:     "local-key",
+		AuthHeader: "X-Api-Key",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := testClient("openai-compatible", provider)
+
+	completion, err := client.ChatCompletion(context.Background(), Request{
+		Messages:       toolConversation,
+		Settings:       ModelSettings{MaxTokens: 1000},
+		ResponseFormat: &ResponseFormat{Name: "verdict", Schema: map[string]any{"type": "object"}},
+	})
+	if err != nil {
+		t.Fatalf("ChatCompletion() error: %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("sent %d requests, want the 429 retried once", requests)
+	}
+
+	// System messages stay messages, and tool results are tool messages
+	if body.Model != "qwen2.5-coder" || body.MaxTokens != 1000 || body.ResponseFormat.Type != "json_object" {
+		t.Errorf("model = %s, max_tokens = %d, response_format = %s", body.Model, body.MaxTokens, body.ResponseFormat.Type)
+	}
+	if len(body.Messages) != len(toolConversation) {
+		t.Fatalf("sent %d messages, want %d", len(body.Messages), len(toolConversation))
+	}
+	for i, want := range toolConversation {
+		got := body.Messages[i]
+		if got.Role != string(want.Role) || got.Content != want.Content || got.ToolCallID != want.ToolCallID || len(got.ToolCalls) != len(want.ToolCalls) {
+			t.Errorf("message %d = %+v, want %+v", i, got, want)
+			continue
+		}
+		for j, call := range want.ToolCalls {
+			gotCall := got.ToolCalls[j]
+			if gotCall.ID != call.ID || gotCall.Type != "function" || gotCall.Function.Name != call.Name || gotCall.Function.Arguments != call.Arguments {
+				t.Errorf("message %d tool call %d = %+v, want %+v", i, j, gotCall, call)
+			}
+		}
+	}
+
+	if completion.Provider != "openai-compatible" || completion.Model != "qwen2.5-coder" {
+		t.Errorf("completion from %s/%s", completion.Provider, completion.Model)
+	}
+	if completion.FinishReason != FinishReasonToolCalls {
+		t.Errorf("finish reason = %s, want %s", completion.FinishReason, FinishReasonToolCalls)
+	}
+	if len(completion.Message.ToolCalls) != 1 || completion.Message.ToolCalls[0] != (ToolCall{ID: "call_3", Name: "get_rule", Arguments: `{"name":"style"}`}) {
+		t.Errorf("tool calls = %+v", completion.Message.ToolCalls)
+	}
+	if completion.Usage != (Usage{InputTokens: 120, OutputTokens: 15}) {
+		t.Errorf("usage = %+v", completion.Usage)
+	}
+}
+
+func TestOpenAIFinishReason(t *testing.T) {
+	tests := map[openai.ChatCompletionChoicesFinishReason]FinishReason{
+		openai.ChatCompletionChoicesFinishReasonStop:          FinishReasonStop,
+		openai.ChatCompletionChoicesFinishReasonLength:        FinishReasonLength,
+		openai.ChatCompletionChoicesFinishReasonToolCalls:     FinishReasonToolCalls,
+		openai.ChatCompletionChoicesFinishReasonFunctionCall:  FinishReasonToolCalls,
+		openai.ChatCompletionChoicesFinishReasonContentFilter: FinishReasonContentFilter,
+	}
+
+	for reason, want := range tests {
+		if got := openAIFinishReason(reason); got != want {
+			t.Errorf("openAIFinishReason(%q) = %s, want %s", reason, got, want)
+		}
+	}
+}
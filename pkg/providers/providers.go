@@ -3,14 +3,13 @@ package providers
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"strings"
 
-	"github.com/openai/openai-go"
+	"github.com/rs/zerolog/log"
 )
 
-type ProviderConfig struct {
-	Messages []ProviderMessage `json:"messages"`
-}
-
 // ProviderMessage represents a chat message
 type ProviderMessage struct {
 	// The contents of the message.
@@ -18,7 +17,9 @@ type ProviderMessage struct {
 	// The role of the author of this message.
 	Role ProviderMessageRole `json:"role"`
 	// The tool calls generated by the model, such as function calls.
-	ToolCalls []openai.ChatCompletionMessageToolCall `json:"tool_calls,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// The tool call this message is responding to, for tool messages.
+	ToolCallID string `json:"tool_call_id,omitempty"`
 }
 
 // The role of the author of this message.
@@ -31,82 +32,419 @@ const (
 	ProviderMessageRoleTool      ProviderMessageRole = "tool"
 )
 
-// Provider defines the interface that all provider clients must implement
+// ToolCall is a request from the model to call one of the request's tools
+type ToolCall struct {
+	// The ID the tool's result must be sent back with
+	ID string `json:"id"`
+	// The name of the tool to call
+	Name string `json:"name"`
+	// The arguments to call the tool with, as a JSON object
+	Arguments string `json:"arguments"`
+}
+
+// Tool is a function the model may call
+type Tool struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// The JSON schema of the tool's arguments
+	Parameters map[string]any `json:"parameters"`
+}
+
+// FinishReason is why the model stopped generating
+type FinishReason string
+
+const (
+	// The model reached a natural stopping point
+	FinishReasonStop FinishReason = "stop"
+	// The model reached the maximum number of tokens
+	FinishReasonLength FinishReason = "length"
+	// The model stopped to call tools
+	FinishReasonToolCalls FinishReason = "tool_calls"
+	// The response was withheld by a content filter
+	FinishReasonContentFilter FinishReason = "content_filter"
+)
+
+// summariseInstructions is the system prompt used to summarise messages
+const summariseInstructions = "You condense reference material for another AI agent. " +
+	"Summarise the messages you are given as briefly as possible while keeping every requirement, " +
+	"including its MUST, SHOULD, COULD or NEVER strength, and any file names, paths, commands or values it mentions. " +
+	"Reply with the summary only."
+
+// summariseRequest follows the messages being summarised
+const summariseRequest = "Summarise the messages above."
+
+// ModelSettings controls which model handles a request and how it samples.
+// Zero values leave the provider's defaults in place.
+type ModelSettings struct {
+	// The model to use, e.g. gpt-4o-mini or claude-3-5-haiku-latest
+	Model string `json:"model,omitempty"`
+	// The sampling temperature, or nil for the provider default
+	Temperature *float64 `json:"temperature,omitempty"`
+	// The maximum number of tokens to generate
+	MaxTokens int64 `json:"max_tokens,omitempty"`
+	// The reasoning effort for reasoning models: low, medium or high
+	ReasoningEffort string `json:"reasoning_effort,omitempty"`
+}
+
+// Merge returns a copy of s with any fields set in override replacing its own
+func (s ModelSettings) Merge(override ModelSettings) ModelSettings {
+	if override.Model != "" {
+		s.Model = override.Model
+	}
+	if override.Temperature != nil {
+		s.Temperature = override.Temperature
+	}
+	if override.MaxTokens > 0 {
+		s.MaxTokens = override.MaxTokens
+	}
+	if override.ReasoningEffort != "" {
+		s.ReasoningEffort = override.ReasoningEffort
+	}
+	return s
+}
+
+// Usage is the number of tokens a request consumed
+type Usage struct {
+	InputTokens  int64 `json:"input_tokens"`
+	OutputTokens int64 `json:"output_tokens"`
+}
+
+// Add adds the tokens of another request to the usage
+func (u *Usage) Add(other Usage) {
+	u.InputTokens += other.InputTokens
+	u.OutputTokens += other.OutputTokens
+}
+
+// Request is a chat completion request in a provider-neutral form
+type Request struct {
+	Messages []ProviderMessage `json:"messages"`
+	Settings ModelSettings     `json:"settings"`
+	// The tools the model may call
+	Tools []Tool `json:"tools,omitempty"`
+	// The structure the reply should follow, nil for free text
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+}
+
+// ResponseFormat asks for a reply that is a JSON object following a schema.
+// Providers without structured outputs rely on the prompt describing it.
+type ResponseFormat struct {
+	Name   string         `json:"name"`
+	Schema map[string]any `json:"schema"`
+}
+
+// Response is a chat completion response in a provider-neutral form
+type Response struct {
+	Message      ProviderMessage `json:"message"`
+	FinishReason FinishReason    `json:"finish_reason"`
+	// The model that served the request, as reported by the provider
+	Model string `json:"model"`
+	Usage Usage  `json:"usage"`
+}
+
+// Provider defines the interface that all provider clients must implement.
+// Each provider adapts the neutral Request and Response to its own API.
 type Provider interface {
-	ChatCompletion(ctx context.Context, messages []any) (any, error)
-	SummariseMessages(messages []any) (any, error)
+	ChatCompletion(ctx context.Context, request Request) (Response, error)
+	SummariseMessages(ctx context.Context, request Request) (Response, error)
+	// The model used when the settings don't name one
+	DefaultModel() string
+}
+
+// summarise wraps a request's messages in instructions to summarise them
+func summarise(request Request) Request {
+	messages := make([]ProviderMessage, 0, len(request.Messages)+2)
+	messages = append(messages, ProviderMessage{
+		Content: summariseInstructions,
+		Role:    ProviderMessageRoleSystem,
+	})
+	messages = append(messages, request.Messages...)
+	messages = append(messages, ProviderMessage{
+		Content: summariseRequest,
+		Role:    ProviderMessageRoleUser,
+	})
+
+	return Request{
+		Messages: messages,
+		Settings: request.Settings,
+	}
+}
+
+// Completion is the response to a request sent through a ProviderClient
+type Completion struct {
+	Response
+	// The provider in the fallback chain that produced the response
+	Provider string
 }
 
-// ProviderClient wraps a Provider implementation
+// ProviderClient wraps an ordered fallback chain of Provider implementations.
+// Requests go to the first provider that is healthy and within its budget,
+// moving down the chain whenever one fails.
 type ProviderClient struct {
+	// The providers in the chain, comma-separated
 	ProviderName string
-	provider     Provider
+	// The settings used for every request unless overridden per call. The
+	// model only applies to the first provider; the others use their own
+	// default models.
+	Settings ModelSettings
+	// How failed requests are retried before falling back
+	Retry RetryPolicy
+	// Overrides the known context window of every model when set, e.g. for
+	// models served locally
+	MaxContextTokens int
+	// Tracks the tokens and dollars spent by every request across the whole
+	// chain, or nil to not track spend
+	Budget   *Budget
+	backends []*backend
 }
 
-// NewClient creates a new provider client based on the provider name
-func NewClient(providerName string) (*ProviderClient, error) {
-	switch providerName {
-	case "openai":
-		client, err := NewOpenAIClient()
+// NewClient creates a new provider client from a provider name, or a
+// comma-separated list of provider names to fall back through in order
+func NewClient(providerName string, settings ModelSettings) (*ProviderClient, error) {
+	client := &ProviderClient{
+		ProviderName: providerName,
+		Retry:        DefaultRetryPolicy,
+	}
+
+	for _, name := range strings.Split(providerName, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		provider, err := newProvider(name)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%s: %w", name, err)
 		}
-		return &ProviderClient{
-			ProviderName: providerName,
-			provider:     client,
-		}, nil
+
+		client.backends = append(client.backends, &backend{
+			name:     name,
+			provider: provider,
+		})
+	}
+
+	if len(client.backends) == 0 {
+		return nil, errors.New("no provider given")
+	}
+
+	if settings.Model == "" {
+		settings.Model = client.backends[0].provider.DefaultModel()
+	}
+	client.Settings = settings
+
+	// A recording remembers its model, so that replays choose the same one
+	if replay, ok := client.backends[0].provider.(*ReplayClient); ok {
+		if err := replay.SaveRecording(settings.Model); err != nil {
+			return nil, fmt.Errorf("replay: failed to save recording: %w", err)
+		}
+	}
+
+	return client, nil
+}
+
+// newProvider creates the Provider implementation for a provider name
+func newProvider(providerName string) (Provider, error) {
+	switch providerName {
+	case "openai":
+		return NewOpenAIClient()
+	case "openai-compatible", "local":
+		return NewOpenAICompatibleClient(OpenAICompatibleConfigFromEnv())
+	case "anthropic":
+		return NewAnthropicClient()
+	case "replay":
+		return NewReplayClient(ReplayConfigFromEnv())
 	default:
 		return nil, errors.New("unsupported provider")
 	}
 }
 
-// ChatCompletion delegates to the underlying provider's ChatCompletion
-func (c *ProviderClient) ChatCompletion(ctx context.Context, messages []ProviderMessage) (any, error) {
-	mappedMessages, err := MapProviderMessages(c.ProviderName, messages)
-	if err != nil {
-		return nil, err
+// SetLimits gives every provider in the chain its own Limiter
+func (c *ProviderClient) SetLimits(limits Limits) {
+	for _, b := range c.backends {
+		b.limiter = NewLimiter(limits)
 	}
-	return c.provider.ChatCompletion(ctx, mappedMessages)
 }
 
-// SummariseMessages delegates to the underlying provider's SummariseMessages
-func (c *ProviderClient) SummariseMessages(messages []ProviderMessage) (any, error) {
-	mappedMessages, err := MapProviderMessages(c.ProviderName, messages)
-	if err != nil {
-		return nil, err
+// SetProviderBudget gives every provider in the chain its own Budget. A
+// provider that has used up its budget is skipped.
+func (c *ProviderClient) SetProviderBudget(maxTokens int64, maxCost float64) {
+	for _, b := range c.backends {
+		b.budget = NewBudget(maxTokens, maxCost)
+	}
+}
+
+// SetPrices replaces every model's known price, in US dollars per million
+// tokens, in the run's budget and each provider's budget. A negative price
+// keeps the known one.
+func (c *ProviderClient) SetPrices(inputPrice float64, outputPrice float64) {
+	budgets := []*Budget{c.Budget}
+	for _, b := range c.backends {
+		budgets = append(budgets, b.budget)
+	}
+
+	for _, budget := range budgets {
+		if budget == nil {
+			continue
+		}
+		if inputPrice >= 0 {
+			budget.InputPrice = &inputPrice
+		}
+		if outputPrice >= 0 {
+			budget.OutputPrice = &outputPrice
+		}
 	}
-	return c.provider.SummariseMessages(mappedMessages)
 }
 
-func MapProviderMessages(providerName string, providerMessages []ProviderMessage) ([]any, error) {
+// Models returns the models requests can go to with the client's settings:
+// the first provider's model and each fallback provider's default model
+func (c *ProviderClient) Models() []string {
+	models := []string{c.Settings.Model}
+	for _, b := range c.backends[1:] {
+		models = append(models, b.provider.DefaultModel())
+	}
+	return models
+}
+
+// ContextWindow returns the number of tokens the model chosen by settings can
+// take as input and output combined
+func (c *ProviderClient) ContextWindow(settings ModelSettings) int {
+	if c.MaxContextTokens > 0 {
+		return c.MaxContextTokens
+	}
+	info, _ := LookupModel(c.Settings.Merge(settings).Model)
+	return info.ContextWindow
+}
+
+// ChatCompletion sends the request to the first available provider's
+// ChatCompletion, with its settings applied on top of the client's own
+func (c *ProviderClient) ChatCompletion(ctx context.Context, request Request) (Completion, error) {
+	return c.call(ctx, request, Provider.ChatCompletion)
+}
+
+// SummariseMessages sends the request to the first available provider's
+// SummariseMessages, with the same settings, retries, limits and fallbacks
+// as ChatCompletion
+func (c *ProviderClient) SummariseMessages(ctx context.Context, request Request) (Completion, error) {
+	return c.call(ctx, request, Provider.SummariseMessages)
+}
+
+// call sends the request with fn to each provider in the chain in turn,
+// until one of them succeeds
+func (c *ProviderClient) call(ctx context.Context, request Request, fn func(Provider, context.Context, Request) (Response, error)) (Completion, error) {
+	request.Settings = c.Settings.Merge(request.Settings)
+
 	var (
-		err      error
-		messages = make([]any, len(providerMessages))
+		lastErr error
+		chain   = candidates(c.backends)
 	)
+	for i, b := range chain {
+		backendRequest := request
+		if b != c.backends[0] {
+			backendRequest.Settings.Model = b.provider.DefaultModel()
+		}
 
-	for i, msg := range providerMessages {
-		messages[i], err = MapProviderMessage(providerName, msg)
-		if err != nil {
-			return nil, err
+		completion, err := c.callBackend(ctx, b, backendRequest, fn)
+		if err == nil {
+			return completion, nil
+		}
+
+		if ctx.Err() != nil {
+			return Completion{}, err
+		}
+
+		lastErr = fmt.Errorf("%s: %w", b.name, err)
+		if i < len(chain)-1 {
+			log.Warn().Err(err).Str("provider", b.name).Msg("Provider failed, falling back to the next provider")
 		}
 	}
-	return messages, nil
+
+	if lastErr == nil {
+		lastErr = errors.New("no provider available: all are out of budget")
+	}
+	return Completion{}, lastErr
 }
 
-func MapProviderMessage(providerName string, message ProviderMessage) (any, error) {
-	switch providerName {
-	case "openai":
-		return MapOpenAIProviderMessage(message), nil
+// unhealthy reports whether a failed request counts against the provider's
+// health: errors that were retried until the attempts ran out, server errors,
+// rejected credentials, and failures to reach the provider or read its reply.
+// Other client errors, such as a prompt too long for the model, are caused by
+// the request and still fall back, but say nothing about the provider.
+func unhealthy(err error) bool {
+	switch status := statusCode(err); {
+	case status >= 500, status == http.StatusUnauthorized, status == http.StatusForbidden:
+		return true
+	case status >= 400:
+		return IsRetryable(err)
 	default:
-		return nil, errors.New("unsupported provider")
+		return true
 	}
 }
 
-func UnmapProviderMessage(providerName string, message any) (ProviderMessage, error) {
-	switch providerName {
-	case "openai":
-		return UnmapOpenAIProviderMessage(message.(openai.ChatCompletionMessage)), nil
+// outputDefaulter is a Provider that asks for a set number of output tokens
+// when the request doesn't limit them, which the limiter counts against the
+// tokens per minute
+type outputDefaulter interface {
+	defaultMaxTokens(model string) int64
+}
+
+// outcomeOf returns how a request that returned err ended, for the limiter
+func outcomeOf(err error) Outcome {
+	switch {
+	case err == nil:
+		return OutcomeSuccess
+	case statusCode(err) == http.StatusTooManyRequests:
+		return OutcomeRateLimited
 	default:
-		return ProviderMessage{}, errors.New("unsupported provider")
+		return OutcomeError
 	}
 }
+
+// callBackend sends the request to a single provider, within its limits and
+// the client's retry policy
+func (c *ProviderClient) callBackend(ctx context.Context, b *backend, request Request, fn func(Provider, context.Context, Request) (Response, error)) (Completion, error) {
+	maxTokens := request.Settings.MaxTokens
+	if d, ok := b.provider.(outputDefaulter); ok && maxTokens == 0 {
+		maxTokens = d.defaultMaxTokens(request.Settings.Model)
+	}
+	tokens := EstimateTokens(request.Messages) + int(maxTokens)
+
+	var response Response
+	err := c.Retry.Do(ctx, func() error {
+		if b.limiter != nil {
+			if err := b.limiter.Acquire(ctx, tokens); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		response, err = fn(b.provider, ctx, request)
+
+		if b.limiter != nil {
+			b.limiter.Release(outcomeOf(err))
+		}
+
+		if err == nil {
+			if response.Model == "" {
+				response.Model = request.Settings.Model
+			}
+			if b.budget != nil {
+				b.budget.Record(response.Model, response.Usage)
+			}
+			if c.Budget != nil {
+				c.Budget.Record(response.Model, response.Usage)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		if ctx.Err() == nil && unhealthy(err) {
+			b.failure()
+		}
+		return Completion{}, err
+	}
+	b.success()
+
+	return Completion{
+		Response: response,
+		Provider: b.name,
+	}, nil
+}
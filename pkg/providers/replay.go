@@ -0,0 +1,240 @@
+package providers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ReplayMode is whether a ReplayClient records or replays
+type ReplayMode string
+
+const (
+	// ReplayModeRecord sends requests to a real provider and saves each
+	// request and response to a cassette
+	ReplayModeRecord ReplayMode = "record"
+	// ReplayModeReplay serves responses from saved cassettes, without any
+	// network access
+	ReplayModeReplay ReplayMode = "replay"
+)
+
+// ReplayConfig configures a ReplayClient
+type ReplayConfig struct {
+	Mode ReplayMode
+	// The directory holding the cassette files
+	Dir string
+	// The provider requests are recorded from, e.g. openai
+	Provider string
+}
+
+// ReplayClient implements the Provider interface by recording requests to a
+// real provider, or replaying responses recorded earlier
+type ReplayClient struct {
+	config ReplayConfig
+	// The provider being recorded, nil when replaying
+	provider Provider
+	// What was recorded, when replaying
+	recording recording
+}
+
+// cassette is a single recorded request and response
+type cassette struct {
+	Kind     string   `json:"kind"`
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// recordingFile describes the recording in a cassette directory
+const recordingFile = "recording.json"
+
+// recording is the provider and model a set of cassettes was recorded with,
+// so that a replay sizes and prices its prompts the same way
+type recording struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+}
+
+// readRecording reads the recording in a cassette directory. Without one,
+// cassettes can only be replayed if BAZ_REPLAY_PROVIDER names the provider
+// they were recorded from.
+func readRecording(config ReplayConfig) (recording, error) {
+	data, err := os.ReadFile(filepath.Join(config.Dir, recordingFile))
+	if os.IsNotExist(err) {
+		if config.Provider == "" {
+			return recording{}, fmt.Errorf("replay: no %s in %s, record the cassettes again or set BAZ_REPLAY_PROVIDER", recordingFile, config.Dir)
+		}
+		return recording{Provider: config.Provider, Model: DefaultModel(config.Provider)}, nil
+	}
+	if err != nil {
+		return recording{}, err
+	}
+
+	var recorded recording
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		return recording{}, fmt.Errorf("replay: failed to read %s: %w", recordingFile, err)
+	}
+	return recorded, nil
+}
+
+// NewReplayClient creates a new record/replay client
+func NewReplayClient(config ReplayConfig) (*ReplayClient, error) {
+	if config.Dir == "" {
+		return nil, errors.New("replay: cassette directory is required")
+	}
+
+	client := &ReplayClient{config: config}
+
+	switch config.Mode {
+	case ReplayModeRecord:
+		if config.Provider == "" || config.Provider == "replay" {
+			return nil, errors.New("replay: a provider to record from is required")
+		}
+		provider, err := newProvider(config.Provider)
+		if err != nil {
+			return nil, err
+		}
+		client.provider = provider
+	case ReplayModeReplay:
+		recorded, err := readRecording(config)
+		if err != nil {
+			return nil, err
+		}
+		client.recording = recorded
+	default:
+		return nil, fmt.Errorf("replay: unsupported mode '%s'", config.Mode)
+	}
+
+	return client, nil
+}
+
+// ReplayConfigFromEnv reads a ReplayConfig from the BAZ_REPLAY_* environment
+// variables
+func ReplayConfigFromEnv() ReplayConfig {
+	config := ReplayConfig{
+		Mode:     ReplayMode(os.Getenv("BAZ_REPLAY_MODE")),
+		Dir:      os.Getenv("BAZ_REPLAY_DIR"),
+		Provider: os.Getenv("BAZ_REPLAY_PROVIDER"),
+	}
+	if config.Mode == "" {
+		config.Mode = ReplayModeReplay
+	}
+	if config.Dir == "" {
+		config.Dir = ".cassettes"
+	}
+	return config
+}
+
+// ChatCompletion implements the Provider interface for replay
+func (c *ReplayClient) ChatCompletion(ctx context.Context, request Request) (Response, error) {
+	return c.do(ctx, "chat", request)
+}
+
+// SummariseMessages implements the Provider interface for replay
+func (c *ReplayClient) SummariseMessages(ctx context.Context, request Request) (Response, error) {
+	return c.do(ctx, "summarise", request)
+}
+
+// DefaultModel implements the Provider interface for replay. Replays use the
+// model the cassettes were recorded with.
+func (c *ReplayClient) DefaultModel() string {
+	if c.provider != nil {
+		return c.provider.DefaultModel()
+	}
+	return c.recording.Model
+}
+
+// SaveRecording notes the provider and model being recorded in the cassette
+// directory. It does nothing when replaying.
+func (c *ReplayClient) SaveRecording(model string) error {
+	if c.config.Mode != ReplayModeRecord {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(recording{
+		Provider: c.config.Provider,
+		Model:    model,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(c.config.Dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(c.config.Dir, recordingFile), data, 0644)
+}
+
+// do records or replays a single request
+func (c *ReplayClient) do(ctx context.Context, kind string, request Request) (Response, error) {
+	key, err := cassetteKey(kind, request)
+	if err != nil {
+		return Response{}, err
+	}
+	path := filepath.Join(c.config.Dir, key+".json")
+
+	if c.config.Mode == ReplayModeReplay {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return Response{}, fmt.Errorf("replay: no cassette recorded for request %s", key)
+			}
+			return Response{}, err
+		}
+
+		var recorded cassette
+		if err := json.Unmarshal(data, &recorded); err != nil {
+			return Response{}, fmt.Errorf("replay: failed to read cassette %s: %w", path, err)
+		}
+		return recorded.Response, nil
+	}
+
+	// Record the request against the real provider
+	var response Response
+	if kind == "summarise" {
+		response, err = c.provider.SummariseMessages(ctx, request)
+	} else {
+		response, err = c.provider.ChatCompletion(ctx, request)
+	}
+	if err != nil {
+		return response, err
+	}
+
+	data, err := json.MarshalIndent(cassette{
+		Kind:     kind,
+		Request:  request,
+		Response: response,
+	}, "", "  ")
+	if err != nil {
+		return response, err
+	}
+
+	if err := os.MkdirAll(c.config.Dir, 0755); err != nil {
+		return response, err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return response, err
+	}
+
+	return response, nil
+}
+
+// cassetteKey hashes the kind of request with everything sent for it: the
+// messages, model settings, tools and response format
+func cassetteKey(kind string, request Request) (string, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(kind))
+	hash.Write([]byte{0})
+	hash.Write(data)
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
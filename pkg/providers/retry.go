@@ -0,0 +1,190 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/openai/openai-go"
+	"github.com/rs/zerolog/log"
+)
+
+// APIError is returned by providers for HTTP error responses
+type APIError struct {
+	Provider   string
+	StatusCode int
+	Type       string
+	Message    string
+	// How long the server asked us to wait before retrying, if it said
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s: %d %s: %s", e.Provider, e.StatusCode, e.Type, e.Message)
+	}
+	return fmt.Sprintf("%s: %d %s", e.Provider, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// RetryPolicy controls how failed provider calls are retried
+type RetryPolicy struct {
+	// The total number of attempts, including the first
+	MaxAttempts int
+	// The backoff before the first retry, doubled on each retry after that
+	BaseDelay time.Duration
+	// The longest backoff between attempts, unless the server asks for longer
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy used by new provider clients
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   time.Second,
+	MaxDelay:    time.Minute,
+}
+
+// Do calls fn until it succeeds, returns a non-retryable error, the context is
+// done or the attempts run out
+func (p RetryPolicy) Do(ctx context.Context, fn func() error) error {
+	attempts := p.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil || !IsRetryable(err) {
+			return err
+		}
+
+		if attempt >= attempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		delay := p.backoff(attempt)
+		if after := retryAfter(err); after > delay {
+			delay = after
+		}
+
+		log.Warn().
+			Err(err).
+			Int("attempt", attempt).
+			Dur("delay", delay).
+			Msg("Retrying provider call")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns an exponential delay with full jitter for the given attempt
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	if p.BaseDelay <= 0 {
+		return 0
+	}
+
+	delay := p.BaseDelay << (attempt - 1)
+	if delay <= 0 || (p.MaxDelay > 0 && delay > p.MaxDelay) {
+		delay = p.MaxDelay
+	}
+
+	return time.Duration(rand.Int63n(int64(delay)) + 1)
+}
+
+// IsRetryable reports whether an error from a provider call is worth retrying:
+// rate limits, server errors, timeouts and dropped connections are, while bad
+// requests, authentication failures and everything else are not
+func IsRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if status := statusCode(err); status != 0 {
+		return isRetryableStatus(status)
+	}
+
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusRequestTimeout ||
+		status == http.StatusConflict ||
+		status == http.StatusTooManyRequests ||
+		status >= http.StatusInternalServerError
+}
+
+// statusCode returns the HTTP status code behind an error, or 0 if there is none
+func statusCode(err error) int {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+
+	var openaiErr *openai.Error
+	if errors.As(err, &openaiErr) {
+		return openaiErr.StatusCode
+	}
+
+	return 0
+}
+
+// retryAfter returns how long the server asked us to wait, or 0 if it didn't
+func retryAfter(err error) time.Duration {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.RetryAfter
+	}
+
+	var openaiErr *openai.Error
+	if errors.As(err, &openaiErr) && openaiErr.Response != nil {
+		return parseRetryAfter(openaiErr.Response.Header)
+	}
+
+	return 0
+}
+
+// parseRetryAfter reads the Retry-After-Ms and Retry-After headers, the latter
+// as either a number of seconds or an HTTP date
+func parseRetryAfter(header http.Header) time.Duration {
+	if ms, err := strconv.ParseFloat(header.Get("Retry-After-Ms"), 64); err == nil && ms > 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+
+	return 0
+}
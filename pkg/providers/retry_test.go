@@ -0,0 +1,138 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/openai/openai-go"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"rate limited", &APIError{StatusCode: http.StatusTooManyRequests}, true},
+		{"server error", &APIError{StatusCode: http.StatusInternalServerError}, true},
+		{"overloaded", &APIError{StatusCode: 529}, true},
+		{"request timeout", &APIError{StatusCode: http.StatusRequestTimeout}, true},
+		{"conflict", &APIError{StatusCode: http.StatusConflict}, true},
+		{"bad request", &APIError{StatusCode: http.StatusBadRequest}, false},
+		{"unauthorized", &APIError{StatusCode: http.StatusUnauthorized}, false},
+		{"not found", &APIError{StatusCode: http.StatusNotFound}, false},
+		{"wrapped", fmt.Errorf("anthropic: %w", &APIError{StatusCode: http.StatusTooManyRequests}), true},
+		{"openai rate limited", &openai.Error{StatusCode: http.StatusTooManyRequests}, true},
+		{"openai bad request", &openai.Error{StatusCode: http.StatusBadRequest}, false},
+		{"dropped connection", io.ErrUnexpectedEOF, true},
+		{"network error", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"canceled", context.Canceled, false},
+		{"deadline exceeded", fmt.Errorf("post: %w", context.DeadlineExceeded), false},
+		{"other", errors.New("failed to decode response"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsRetryable(test.err); got != test.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    time.Duration
+	}{
+		{"none", nil, 0},
+		{"seconds", map[string]string{"Retry-After": "2"}, 2 * time.Second},
+		{"fractional seconds", map[string]string{"Retry-After": "1.5"}, 1500 * time.Millisecond},
+		{"milliseconds", map[string]string{"Retry-After-Ms": "250"}, 250 * time.Millisecond},
+		{"milliseconds first", map[string]string{"Retry-After-Ms": "250", "Retry-After": "2"}, 250 * time.Millisecond},
+		{"negative", map[string]string{"Retry-After": "-1"}, 0},
+		{"invalid", map[string]string{"Retry-After": "soon"}, 0},
+		{"past date", map[string]string{"Retry-After": time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)}, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			for key, value := range test.headers {
+				header.Set(key, value)
+			}
+			if got := parseRetryAfter(header); got != test.want {
+				t.Errorf("parseRetryAfter(%v) = %v, want %v", test.headers, got, test.want)
+			}
+		})
+	}
+
+	t.Run("date", func(t *testing.T) {
+		header := http.Header{}
+		header.Set("Retry-After", time.Now().Add(30*time.Second).UTC().Format(http.TimeFormat))
+
+		// HTTP dates are to the second
+		if got := parseRetryAfter(header); got < 28*time.Second || got > 30*time.Second {
+			t.Errorf("parseRetryAfter(%v) = %v, want about 30s", header, got)
+		}
+	})
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+		wantErr  bool
+	}{
+		{"success", []error{nil}, 1, false},
+		{"retried", []error{&APIError{StatusCode: http.StatusTooManyRequests}, nil}, 2, false},
+		{"not retryable", []error{&APIError{StatusCode: http.StatusBadRequest}, nil}, 1, true},
+		{"attempts run out", []error{io.ErrUnexpectedEOF, io.ErrUnexpectedEOF, io.ErrUnexpectedEOF, nil}, 3, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			err := policy.Do(context.Background(), func() error {
+				attempts++
+				return test.errs[attempts-1]
+			})
+			if attempts != test.attempts {
+				t.Errorf("Do() made %d attempts, want %d", attempts, test.attempts)
+			}
+			if (err != nil) != test.wantErr {
+				t.Errorf("Do() error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDoWaitsRetryAfter(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	attempts := 0
+	start := time.Now()
+	err := policy.Do(context.Background(), func() error {
+		attempts++
+		if attempts == 1 {
+			return &APIError{StatusCode: http.StatusTooManyRequests, RetryAfter: 50 * time.Millisecond}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Do() error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Do() retried after %v, want at least the 50ms asked for", elapsed)
+	}
+}
@@ -0,0 +1,20 @@
+package providers
+
+// Roughly how many characters make up a token in English text and code
+const charsPerToken = 4
+
+// Tokens added to every message for its role and formatting
+const tokensPerMessage = 4
+
+// EstimateTokens approximates the number of prompt tokens in a set of
+// messages without calling a provider-specific tokenizer
+func EstimateTokens(messages []ProviderMessage) int {
+	tokens := 0
+	for _, message := range messages {
+		tokens += tokensPerMessage + (len(message.Content)+charsPerToken-1)/charsPerToken
+		for _, call := range message.ToolCalls {
+			tokens += (len(call.Name) + len(call.Arguments) + charsPerToken - 1) / charsPerToken
+		}
+	}
+	return tokens
+}
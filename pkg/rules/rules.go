@@ -3,13 +3,56 @@ package rules
 import (
 	"concept/pkg/mdc"
 
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+// Attachment is how a rule is attached to files, following Cursor's rule types
+type Attachment string
+
+const (
+	// AttachmentAlways rules apply to every file
+	AttachmentAlways Attachment = "always"
+	// AttachmentAuto rules apply to files matching their globs
+	AttachmentAuto Attachment = "auto"
+	// AttachmentAgentRequested rules are chosen by the model from their
+	// descriptions
+	AttachmentAgentRequested Attachment = "agent_requested"
+	// AttachmentManual rules apply only when named
+	AttachmentManual Attachment = "manual"
+)
+
+// AttachmentOf returns how a rule is attached from its frontmatter
+func AttachmentOf(rule mdc.Mdc) Attachment {
+	switch {
+	case rule.AlwaysApply:
+		return AttachmentAlways
+	case len(rule.Globs) > 0:
+		return AttachmentAuto
+	case rule.Description != "":
+		return AttachmentAgentRequested
+	default:
+		return AttachmentManual
+	}
+}
+
+// Name returns a rule's name: its path within .cursor/rules without the .mdc
+// extension
+func Name(rule mdc.Mdc) string {
+	name, err := filepath.Rel(".cursor/rules", rule.Path)
+	if err != nil || strings.HasPrefix(name, "..") {
+		name = filepath.Base(rule.Path)
+	}
+	return strings.TrimSuffix(filepath.ToSlash(name), ".mdc")
+}
+
 // Rules represents a collection of rules with methods to match files
 type Rules struct {
 	rules []mdc.Mdc
+	// The rules named to apply to every file, by path
+	selected map[string]bool
 }
 
 // New creates a new Rules instance from a slice of file paths
@@ -17,24 +60,61 @@ func New(filePaths []string) (*Rules, error) {
 	rules := make([]mdc.Mdc, 0, len(filePaths))
 
 	for _, path := range filePaths {
-		rule, err := parseRuleFile(filepath.Join(".cursor/rules", path))
+		rule, err := ParseFile(filepath.Join(".cursor/rules", path))
 		if err != nil {
 			return nil, err
 		}
 		rules = append(rules, rule)
 	}
 
-	return &Rules{rules: rules}, nil
+	return &Rules{rules: rules, selected: map[string]bool{}}, nil
+}
+
+// Select names rules to apply to every file, whatever their attachment. This
+// is the only way manual rules apply. Names are as returned by Name, or the
+// rule's file name.
+func (r *Rules) Select(names []string) error {
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.TrimSpace(name), ".mdc")
+		if name == "" {
+			continue
+		}
+
+		found := false
+		for _, rule := range r.rules {
+			if Name(rule) == name || strings.TrimSuffix(filepath.Base(rule.Path), ".mdc") == name {
+				r.selected[rule.Path] = true
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("no rule named '%s'", name)
+		}
+	}
+
+	return nil
 }
 
-// GetMatchingRules returns all rules that match the given file path
+// GetMatchingRules returns the rules that apply to the given file path: always
+// rules, auto attached rules whose globs match, and selected rules
 func (r *Rules) GetMatchingRules(filePath string) []mdc.Mdc {
 	matching := make([]mdc.Mdc, 0)
 
 	for _, rule := range r.rules {
-		for _, ruleGlob := range rule.Globs {
-			if ruleGlob.Match(filePath) {
-				matching = append(matching, rule)
+		if r.selected[rule.Path] {
+			matching = append(matching, rule)
+			continue
+		}
+
+		switch AttachmentOf(rule) {
+		case AttachmentAlways:
+			matching = append(matching, rule)
+		case AttachmentAuto:
+			for _, ruleGlob := range rule.Globs {
+				if ruleGlob.Match(filePath) {
+					matching = append(matching, rule)
+					break
+				}
 			}
 		}
 	}
@@ -42,8 +122,22 @@ func (r *Rules) GetMatchingRules(filePath string) []mdc.Mdc {
 	return matching
 }
 
-// parseRuleFile reads a markdown file with TOML frontmatter and returns a Rule
-func parseRuleFile(filePath string) (mdc.Mdc, error) {
+// GetAgentRequestedRules returns the rules the model may choose to apply from
+// their descriptions, leaving out any already selected
+func (r *Rules) GetAgentRequestedRules() []mdc.Mdc {
+	requested := make([]mdc.Mdc, 0)
+
+	for _, rule := range r.rules {
+		if AttachmentOf(rule) == AttachmentAgentRequested && !r.selected[rule.Path] {
+			requested = append(requested, rule)
+		}
+	}
+
+	return requested
+}
+
+// ParseFile reads a markdown file with YAML frontmatter and returns a Rule
+func ParseFile(filePath string) (mdc.Mdc, error) {
 	var rule mdc.Mdc
 
 	// Read the file
@@ -55,7 +149,7 @@ func parseRuleFile(filePath string) (mdc.Mdc, error) {
 	// Parse the frontmatter (MDC)
 	mdc, err := mdc.Unmarshal(content)
 	if err != nil {
-		return rule, err
+		return rule, fmt.Errorf("%s: %w", filePath, err)
 	}
 
 	mdc.Path = filePath
@@ -0,0 +1,286 @@
+package selection
+
+import (
+	"concept/pkg/git"
+	"concept/pkg/mdc"
+	"concept/pkg/providers"
+	"concept/pkg/rules"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheFile is where selections are cached, relative to the repository
+// root
+const DefaultCacheFile = ".patches/rule-selections.json"
+
+const (
+	// The most lines and bytes of a file shown to the model
+	excerptLines = 60
+	excerptBytes = 4000
+)
+
+// instructions tell the model how to choose rules
+const instructions = `You choose which coding rules apply to a file.
+
+You'll be given a file's path, an excerpt of its content, and a list of rules, each with an id and a description. Reply with a JSON object of the form {"rules": ["<id>", ...]} listing the ids of the rules that apply to the file. Only list rules whose description clearly applies; reply with {"rules": []} if none do.`
+
+// Decision is the rules chosen for one version of a file
+type Decision struct {
+	File string `json:"file"`
+	// The git blob id of the file's content when the rules were chosen
+	Blob  string `json:"blob"`
+	Model string `json:"model"`
+	// The names of the chosen rules, as returned by rules.Name
+	Rules     []string        `json:"rules"`
+	Usage     providers.Usage `json:"usage"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// Cache keeps the decisions made for each file in a JSON file, so that files
+// which haven't changed aren't sent again
+type Cache struct {
+	path string
+
+	mu        sync.Mutex
+	decisions map[string]Decision
+}
+
+// LoadCache reads the cache at path. A missing file is an empty cache.
+func LoadCache(path string) (*Cache, error) {
+	cache := &Cache{path: path, decisions: map[string]Decision{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &cache.decisions); err != nil {
+		return nil, fmt.Errorf("selection: failed to read cache %s: %w", path, err)
+	}
+
+	return cache, nil
+}
+
+// get returns the decision cached under key
+func (c *Cache) get(key string) (Decision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	decision, ok := c.decisions[key]
+	return decision, ok
+}
+
+// Lookup returns the candidate rules chosen for the file's content by model in
+// a cached decision, without asking the model
+func (c *Cache) Lookup(file string, content []byte, model string, candidates []mdc.Mdc) ([]mdc.Mdc, bool) {
+	decision, ok := c.get(Key(file, git.HashBlob(content), model, candidates))
+	if !ok {
+		return nil, false
+	}
+	return chosen(candidates, decision.Rules), true
+}
+
+// put caches a decision under key, replacing any made for earlier versions
+// of the file
+func (c *Cache) put(key string, decision Decision) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, d := range c.decisions {
+		if d.File == decision.File {
+			delete(c.decisions, k)
+		}
+	}
+	c.decisions[key] = decision
+}
+
+// Save writes the cache to its file, creating any missing directories
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	data, err := json.MarshalIndent(c.decisions, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return fmt.Errorf("selection: failed to create directory for %s: %w", c.path, err)
+	}
+	return os.WriteFile(c.path, data, 0644)
+}
+
+// Selector asks a model which agent requested rules apply to a file
+type Selector struct {
+	client   *providers.ProviderClient
+	settings providers.ModelSettings
+	// The cache of earlier decisions, nil to always ask
+	cache *Cache
+}
+
+// NewSelector creates a selector that sends requests through client with
+// settings, usually naming a small, cheap model
+func NewSelector(client *providers.ProviderClient, settings providers.ModelSettings, cache *Cache) *Selector {
+	return &Selector{client: client, settings: settings, cache: cache}
+}
+
+// Select returns the candidate rules that apply to the file, and the usage
+// of the request made to choose them, which is zero when the decision was
+// cached
+func (s *Selector) Select(ctx context.Context, file string, content []byte, candidates []mdc.Mdc) ([]mdc.Mdc, providers.Usage, error) {
+	if len(candidates) == 0 {
+		return nil, providers.Usage{}, nil
+	}
+
+	blob := git.HashBlob(content)
+	model := s.client.Settings.Merge(s.settings).Model
+	key := Key(file, blob, model, candidates)
+
+	if s.cache != nil {
+		if decision, ok := s.cache.get(key); ok {
+			return chosen(candidates, decision.Rules), providers.Usage{}, nil
+		}
+	}
+
+	completion, err := s.client.ChatCompletion(ctx, providers.Request{
+		Messages:       Messages(file, string(content), candidates),
+		Settings:       s.settings,
+		ResponseFormat: ResponseFormat(),
+	})
+	if err != nil {
+		return nil, providers.Usage{}, err
+	}
+
+	names, err := Parse(completion.Message.Content)
+	if err != nil {
+		return nil, completion.Usage, err
+	}
+
+	selected := chosen(candidates, names)
+	if s.cache != nil {
+		decision := Decision{
+			File:      file,
+			Blob:      blob,
+			Model:     completion.Model,
+			Rules:     make([]string, len(selected)),
+			Usage:     completion.Usage,
+			CreatedAt: time.Now().UTC(),
+		}
+		for i, rule := range selected {
+			decision.Rules[i] = rules.Name(rule)
+		}
+		s.cache.put(key, decision)
+	}
+
+	return selected, completion.Usage, nil
+}
+
+// Key identifies a decision by the file's path and content, the model and the
+// candidate rules, so that changing any of them asks again
+func Key(file string, blob string, model string, candidates []mdc.Mdc) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00%s\x00", file, blob, model)
+	for _, rule := range candidates {
+		fmt.Fprintf(hash, "%s\x00%s\x00", rules.Name(rule), rule.Description)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Messages returns the request asking the model to choose rules for a file
+func Messages(file string, content string, candidates []mdc.Mdc) []providers.ProviderMessage {
+	lines := []string{"File: " + file, "", "```", excerpt(content), "```", "", "Rules:", ""}
+	for _, rule := range candidates {
+		lines = append(lines, "- "+rules.Name(rule)+": "+rule.Description)
+	}
+
+	return []providers.ProviderMessage{
+		{
+			Content: instructions,
+			Role:    providers.ProviderMessageRoleSystem,
+		},
+		{
+			Content: strings.Join(lines, "\n"),
+			Role:    providers.ProviderMessageRoleUser,
+		},
+	}
+}
+
+// excerpt returns the start of a file's content
+func excerpt(content string) string {
+	lines := strings.SplitAfter(content, "\n")
+	if len(lines) > excerptLines {
+		content = strings.Join(lines[:excerptLines], "")
+	}
+	if len(content) > excerptBytes {
+		content = content[:excerptBytes]
+	}
+	return strings.TrimSuffix(content, "\n")
+}
+
+// ResponseFormat returns the schema of the reply
+func ResponseFormat() *providers.ResponseFormat {
+	return &providers.ResponseFormat{
+		Name: "rule_selection",
+		Schema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"rules": map[string]any{
+					"type":  "array",
+					"items": map[string]any{"type": "string"},
+				},
+			},
+			"required":             []string{"rules"},
+			"additionalProperties": false,
+		},
+	}
+}
+
+// Parse reads the names of the chosen rules from the model's reply
+func Parse(reply string) ([]string, error) {
+	reply = strings.TrimSpace(reply)
+
+	start := strings.Index(reply, "{")
+	end := strings.LastIndex(reply, "}")
+	if start < 0 || end < start {
+		return nil, errors.New("selection: reply is not a JSON object")
+	}
+
+	var selection struct {
+		Rules *[]string `json:"rules"`
+	}
+	if err := json.Unmarshal([]byte(reply[start:end+1]), &selection); err != nil {
+		return nil, fmt.Errorf("selection: failed to decode reply: %w", err)
+	}
+	if selection.Rules == nil {
+		return nil, errors.New("selection: reply lists no rules")
+	}
+
+	return *selection.Rules, nil
+}
+
+// chosen returns the candidates named, in their original order. Names that
+// match no candidate are ignored.
+func chosen(candidates []mdc.Mdc, names []string) []mdc.Mdc {
+	named := map[string]bool{}
+	for _, name := range names {
+		named[strings.TrimSuffix(strings.TrimSpace(name), ".mdc")] = true
+	}
+
+	selected := []mdc.Mdc{}
+	for _, rule := range candidates {
+		if named[rules.Name(rule)] {
+			selected = append(selected, rule)
+		}
+	}
+	return selected
+}
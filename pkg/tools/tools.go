@@ -0,0 +1,393 @@
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"concept/pkg/loader"
+	"concept/pkg/providers"
+	"concept/pkg/rules"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Limits on how much a single tool call can return
+const (
+	maxReadBytes   = 64 * 1024
+	maxListEntries = 500
+	maxGrepMatches = 200
+	maxGrepFile    = 1024 * 1024
+	maxGrepLine    = 1000
+)
+
+// deniedNames are files and directories the model can never read, whatever
+// the ignore patterns say, as they hold secrets or the tool's own state
+var deniedNames = []string{".git", ".patches", ".cassettes"}
+
+// Tools runs the model's tool calls, sandboxed to a root directory
+type Tools struct {
+	root  string
+	rules *rules.Rules
+	// The loader's ignore patterns, which the model can't read past either
+	ignore []string
+}
+
+// New creates Tools that can only read inside root, and not the paths
+// matching the ignore patterns
+func New(root string, rules *rules.Rules, ignore []string) (*Tools, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve symlinks so that paths can be compared with resolved targets
+	absRoot, err = filepath.EvalSymlinks(absRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tools{
+		root:   absRoot,
+		rules:  rules,
+		ignore: ignore,
+	}, nil
+}
+
+// Definitions returns the tools to offer the model
+func (t *Tools) Definitions() []providers.Tool {
+	return []providers.Tool{
+		{
+			Name:        "read_file",
+			Description: "Read a file in the repository. Paths are relative to the repository root.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"path": map[string]any{"type": "string", "description": "The file to read"},
+				},
+				"required": []string{"path"},
+			},
+		},
+		{
+			Name:        "list_dir",
+			Description: "List the files and directories in a directory of the repository. Directories end with a slash.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"path": map[string]any{"type": "string", "description": "The directory to list, or . for the repository root"},
+				},
+				"required": []string{"path"},
+			},
+		},
+		{
+			Name:        "grep",
+			Description: "Search the repository's files for lines matching a regular expression. Returns path:line: text for each match.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"pattern": map[string]any{"type": "string", "description": "An RE2 regular expression"},
+					"path":    map[string]any{"type": "string", "description": "The file or directory to search, defaults to the repository root"},
+				},
+				"required": []string{"pattern"},
+			},
+		},
+		{
+			Name:        "get_rule",
+			Description: "Read a rule by its path or description, including rules that don't apply to the file under review.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"name": map[string]any{"type": "string", "description": "The rule's path, file name or description"},
+				},
+				"required": []string{"name"},
+			},
+		},
+	}
+}
+
+// Call runs a tool call and returns its result. Failures are returned as the
+// result so that the model can see what went wrong and try something else.
+func (t *Tools) Call(call providers.ToolCall) string {
+	var args struct {
+		Path    string `json:"path"`
+		Pattern string `json:"pattern"`
+		Name    string `json:"name"`
+	}
+	if call.Arguments != "" {
+		if err := json.Unmarshal([]byte(call.Arguments), &args); err != nil {
+			return "error: invalid arguments: " + err.Error()
+		}
+	}
+
+	log.Debug().
+		Str("tool", call.Name).
+		Str("arguments", call.Arguments).
+		Msg("Calling tool")
+
+	var (
+		result string
+		err    error
+	)
+	switch call.Name {
+	case "read_file":
+		result, err = t.readFile(args.Path)
+	case "list_dir":
+		result, err = t.listDir(args.Path)
+	case "grep":
+		result, err = t.grep(args.Pattern, args.Path)
+	case "get_rule":
+		result, err = t.getRule(args.Name)
+	default:
+		err = fmt.Errorf("unknown tool %q", call.Name)
+	}
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return result
+}
+
+// resolve returns the absolute path for a path relative to the root, refusing
+// any path that leads outside it, including through symlinks
+func (t *Tools) resolve(path string) (string, error) {
+	if path == "" {
+		path = "."
+	}
+	if filepath.IsAbs(path) {
+		return "", errors.New("path must be relative to the repository root")
+	}
+
+	full := filepath.Join(t.root, path)
+	if !t.inRoot(full) {
+		return "", errors.New("path is outside the repository")
+	}
+	if t.denied(full) {
+		return "", fmt.Errorf("%s is ignored and can't be read", path)
+	}
+
+	resolved, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("%s does not exist", path)
+		}
+		return "", err
+	}
+	if !t.inRoot(resolved) {
+		return "", errors.New("path is outside the repository")
+	}
+	if t.denied(resolved) {
+		return "", fmt.Errorf("%s is ignored and can't be read", path)
+	}
+
+	return resolved, nil
+}
+
+func (t *Tools) inRoot(path string) bool {
+	rel, err := filepath.Rel(t.root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// denied reports whether a path inside the root is off limits: .env files,
+// the tool's own directories, or anything matching the ignore patterns
+func (t *Tools) denied(path string) bool {
+	rel := t.relative(path)
+	if rel == "." {
+		return false
+	}
+
+	for _, name := range strings.Split(rel, "/") {
+		if strings.HasPrefix(name, ".env") {
+			return true
+		}
+		for _, denied := range deniedNames {
+			if name == denied {
+				return true
+			}
+		}
+	}
+
+	// Directory patterns such as .patches/ also match the directory itself
+	for _, candidate := range []string{rel, rel + "/"} {
+		ignored, err := loader.Ignored(candidate, t.ignore)
+		if ignored || err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// relative returns a path relative to the root for display
+func (t *Tools) relative(path string) string {
+	rel, err := filepath.Rel(t.root, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (t *Tools) readFile(path string) (string, error) {
+	full, err := t.resolve(path)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(full)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("%s is a directory", path)
+	}
+
+	file, err := os.Open(full)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(io.LimitReader(file, maxReadBytes))
+	if err != nil {
+		return "", err
+	}
+
+	result := string(content)
+	if info.Size() > maxReadBytes {
+		result += fmt.Sprintf("\n[truncated: showing %d of %d bytes]", maxReadBytes, info.Size())
+	}
+	return result, nil
+}
+
+func (t *Tools) listDir(path string) (string, error) {
+	full, err := t.resolve(path)
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := os.ReadDir(full)
+	if err != nil {
+		return "", err
+	}
+
+	var lines []string
+	for _, entry := range entries {
+		if t.denied(filepath.Join(full, entry.Name())) {
+			continue
+		}
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		lines = append(lines, name)
+		if len(lines) == maxListEntries {
+			lines = append(lines, fmt.Sprintf("[truncated: showing %d of %d entries]", maxListEntries, len(entries)))
+			break
+		}
+	}
+
+	if len(lines) == 0 {
+		return "(empty)", nil
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (t *Tools) grep(pattern string, path string) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid pattern: %w", err)
+	}
+
+	full, err := t.resolve(path)
+	if err != nil {
+		return "", err
+	}
+
+	var matches []string
+	errLimit := errors.New("limit reached")
+
+	err = filepath.Walk(full, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if t.denied(p) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if !info.Mode().IsRegular() || info.Size() > maxGrepFile {
+			return nil
+		}
+
+		content, err := os.ReadFile(p)
+		if err != nil || bytes.IndexByte(content, 0) >= 0 {
+			// skip unreadable and binary files
+			return nil
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		scanner.Buffer(make([]byte, 0, 64*1024), maxGrepFile)
+		for line := 1; scanner.Scan(); line++ {
+			if re.MatchString(scanner.Text()) {
+				matches = append(matches, fmt.Sprintf("%s:%d: %s", t.relative(p), line, truncateLine(scanner.Text())))
+				if len(matches) == maxGrepMatches {
+					return errLimit
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errLimit {
+		return "", err
+	}
+
+	if len(matches) == 0 {
+		return "no matches", nil
+	}
+	if err == errLimit {
+		matches = append(matches, fmt.Sprintf("[truncated: showing the first %d matches]", maxGrepMatches))
+	}
+	return strings.Join(matches, "\n"), nil
+}
+
+// truncateLine cuts a matched line down to maxGrepLine bytes, so that a long
+// line such as minified code doesn't fill the reply
+func truncateLine(line string) string {
+	if len(line) <= maxGrepLine {
+		return line
+	}
+	// Drop any rune split by the cut
+	cut := strings.ToValidUTF8(line[:maxGrepLine], "")
+	return cut + fmt.Sprintf(" [truncated: showing %d of %d bytes]", len(cut), len(line))
+}
+
+func (t *Tools) getRule(name string) (string, error) {
+	if t.rules == nil {
+		return "", errors.New("no rules loaded")
+	}
+
+	var available []string
+	for _, rule := range t.rules.GetAllRules() {
+		if rule.Path == name ||
+			filepath.Base(rule.Path) == name ||
+			strings.TrimSuffix(filepath.Base(rule.Path), ".mdc") == name ||
+			strings.EqualFold(rule.Description, name) {
+			return "Rule: " + rule.Path + " (" + rule.Description + ")\n\n" + rule.Content, nil
+		}
+		available = append(available, rule.Path+" ("+rule.Description+")")
+	}
+
+	sort.Strings(available)
+	return "", fmt.Errorf("no rule named %q, available rules:\n%s", name, strings.Join(available, "\n"))
+}
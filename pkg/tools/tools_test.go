@@ -0,0 +1,184 @@
+package tools
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestTools creates Tools over a repository holding secrets, ignored files
+// and symlinks, next to a directory outside it
+func newTestTools(t *testing.T) *Tools {
+	t.Helper()
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "repo")
+	outside := filepath.Join(dir, "outside")
+
+	files := map[string]string{
+		"repo/src/a.go":          "package a\n\n// TODO: a\n",
+		"repo/src/.env.test":     "TODO=secret\n",
+		"repo/.env":              "TODO=secret\n",
+		"repo/.env.local":        "TODO=secret\n",
+		"repo/.git/config":       "TODO secret\n",
+		"repo/secret/key.txt":    "TODO secret\n",
+		"repo/long.txt":          "TODO " + strings.Repeat("x", 2*maxGrepLine) + "\n",
+		"outside/passwd":         "TODO secret\n",
+		"outside/nested/file.go": "TODO secret\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		"link":    filepath.Join(outside, "passwd"),
+		"linkdir": outside,
+		"envlink": filepath.Join(root, ".env"),
+		"srclink": filepath.Join(root, "src"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+	}
+
+	tools, err := New(root, nil, []string{"secret/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tools
+}
+
+func TestResolve(t *testing.T) {
+	tools := newTestTools(t)
+
+	tests := []struct {
+		path string
+		// A part of the error, or empty if the path resolves
+		err string
+	}{
+		{path: "src/a.go"},
+		{path: "src/../src/a.go"},
+		{path: "srclink/a.go"},
+		{path: "."},
+		{path: "../outside/passwd", err: "outside the repository"},
+		{path: "..", err: "outside the repository"},
+		{path: "src/../../outside/passwd", err: "outside the repository"},
+		{path: "/etc/passwd", err: "relative"},
+		{path: "link", err: "outside the repository"},
+		{path: "linkdir/nested/file.go", err: "outside the repository"},
+		{path: ".env", err: "ignored"},
+		{path: ".env.local", err: "ignored"},
+		{path: "src/.env.test", err: "ignored"},
+		{path: "envlink", err: "ignored"},
+		{path: ".git", err: "ignored"},
+		{path: ".git/config", err: "ignored"},
+		{path: "secret", err: "ignored"},
+		{path: "secret/key.txt", err: "ignored"},
+		{path: "missing.go", err: "does not exist"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			got, err := tools.resolve(test.path)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("resolve(%q) error: %v", test.path, err)
+				}
+				if !tools.inRoot(got) {
+					t.Errorf("resolve(%q) = %q, outside the root", test.path, got)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("resolve(%q) = %q, %v, want an error containing %q", test.path, got, err, test.err)
+			}
+		})
+	}
+}
+
+func TestListDir(t *testing.T) {
+	tools := newTestTools(t)
+
+	got, err := tools.listDir(".")
+	if err != nil {
+		t.Fatalf("listDir() error: %v", err)
+	}
+	entries := strings.Split(got, "\n")
+
+	for _, want := range []string{"src/", "long.txt"} {
+		if !contains(entries, want) {
+			t.Errorf("listDir() = %q, want %s listed", entries, want)
+		}
+	}
+	for _, hidden := range []string{".env", ".env.local", ".git/", "secret/"} {
+		if contains(entries, hidden) {
+			t.Errorf("listDir() = %q, want %s hidden", entries, hidden)
+		}
+	}
+
+	got, err = tools.listDir("src")
+	if err != nil {
+		t.Fatalf("listDir(src) error: %v", err)
+	}
+	if got != "a.go" {
+		t.Errorf("listDir(src) = %q, want only a.go", got)
+	}
+}
+
+func TestGrep(t *testing.T) {
+	tools := newTestTools(t)
+
+	got, err := tools.grep("TODO", ".")
+	if err != nil {
+		t.Fatalf("grep() error: %v", err)
+	}
+	lines := strings.Split(got, "\n")
+
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "long.txt:1: TODO x") || lines[1] != "src/a.go:3: // TODO: a" {
+		t.Fatalf("grep() = %q, want matches in long.txt and src/a.go only", lines)
+	}
+	if !strings.HasSuffix(lines[0], "[truncated: showing 1000 of 2005 bytes]") {
+		t.Errorf("grep() long line = %q, want it truncated", lines[0])
+	}
+	if len(lines[0]) > maxGrepLine+100 {
+		t.Errorf("grep() long line has %d bytes, want at most about %d", len(lines[0]), maxGrepLine)
+	}
+
+	for _, path := range []string{"secret", ".git", ".env", "linkdir"} {
+		if got, err := tools.grep("TODO", path); err == nil {
+			t.Errorf("grep(%s) = %q, want an error", path, got)
+		}
+	}
+}
+
+func TestTruncateLine(t *testing.T) {
+	short := "short line"
+	if got := truncateLine(short); got != short {
+		t.Errorf("truncateLine(%q) = %q, want it unchanged", short, got)
+	}
+
+	// A rune split by the cut is dropped rather than left broken
+	long := strings.Repeat("x", maxGrepLine-1) + "é" + "tail"
+	got := truncateLine(long)
+	want := strings.Repeat("x", maxGrepLine-1) + " [truncated: showing 999 of 1005 bytes]"
+	if got != want {
+		t.Errorf("truncateLine() = %q, want %q", got[maxGrepLine-10:], want[maxGrepLine-10:])
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
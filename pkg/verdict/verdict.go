@@ -0,0 +1,197 @@
+package verdict
+
+import (
+	"concept/pkg/edit"
+	"concept/pkg/providers"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Status is the outcome of a review
+type Status string
+
+const (
+	// StatusUnchanged means the file already follows the rules
+	StatusUnchanged Status = "unchanged"
+	// StatusChanged means the file was rewritten to follow the rules
+	StatusChanged Status = "changed"
+	// StatusError means the model could not review the file
+	StatusError Status = "error"
+)
+
+// Mode is how the model returns its changes
+type Mode string
+
+const (
+	// ModeRewrite returns the entire rewritten file
+	ModeRewrite Mode = "rewrite"
+	// ModeEdits returns search/replace and line-range edits to the file
+	ModeEdits Mode = "edits"
+)
+
+// ParseMode reads a mode from a flag value
+func ParseMode(value string) (Mode, error) {
+	switch Mode(value) {
+	case ModeRewrite, ModeEdits:
+		return Mode(value), nil
+	}
+	return "", fmt.Errorf("unknown edit mode '%s', expected %s or %s", value, ModeRewrite, ModeEdits)
+}
+
+// Violation is a place where the file breaks a rule
+type Violation struct {
+	// The path of the rule that is broken
+	Rule        string `json:"rule"`
+	Description string `json:"description"`
+	// Whether the rewritten content fixes the violation
+	Fixed bool `json:"fixed"`
+}
+
+// Verdict is the model's structured reply to a review
+type Verdict struct {
+	Status Status `json:"status"`
+	// The entire rewritten file when the status is changed, in rewrite mode
+	Content string `json:"content,omitempty"`
+	// The changes to the file when the status is changed, in edits mode
+	Edits      []edit.Edit `json:"edits,omitempty"`
+	Violations []Violation `json:"violations"`
+	// Why the model did or didn't change the file
+	Rationale string `json:"rationale"`
+}
+
+// Instructions describes the reply format for the prompt, for providers that
+// can't enforce the schema themselves
+func Instructions(mode Mode) []string {
+	instructions := []string{
+		"Reply with only a JSON object, without code fences, with these fields:",
+		"",
+		"- status: \"changed\" if the file needs changes, \"unchanged\" if it doesn't, or \"error\" if you can't review it.",
+	}
+
+	if mode == ModeEdits {
+		instructions = append(instructions,
+			"- edits: the changes when the status is changed, otherwise an empty list. Each edit either replaces search, text copied exactly from the file that appears only once in it, with replace; or, with an empty search, replaces the lines start_line to end_line, counting from 1, with replace. Set end_line to start_line - 1 to insert before start_line. Use 0 for the line numbers of search edits. Edits refer to the original file and must not overlap.",
+			"The file is shown with each line prefixed by its number and \"| \". The prefixes are not part of the file: use them for start_line and end_line, and leave them out of search and replace.",
+		)
+	} else {
+		instructions = append(instructions,
+			"- content: the entire rewritten file, without code fences, when the status is changed, otherwise an empty string.",
+		)
+	}
+
+	return append(instructions,
+		"- violations: every place the file breaks a rule, each with the rule's path as rule, a description, and whether your changes fixed it as fixed.",
+		"- rationale: a short explanation of your decision, or of the error.",
+	)
+}
+
+// ResponseFormat returns the schema the reply should follow
+func ResponseFormat(mode Mode) *providers.ResponseFormat {
+	properties := map[string]any{
+		"status": map[string]any{
+			"type": "string",
+			"enum": []string{string(StatusUnchanged), string(StatusChanged), string(StatusError)},
+		},
+		"violations": map[string]any{
+			"type": "array",
+			"items": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"rule":        map[string]any{"type": "string"},
+					"description": map[string]any{"type": "string"},
+					"fixed":       map[string]any{"type": "boolean"},
+				},
+				"required":             []string{"rule", "description", "fixed"},
+				"additionalProperties": false,
+			},
+		},
+		"rationale": map[string]any{"type": "string"},
+	}
+	required := []string{"status", "violations", "rationale"}
+
+	if mode == ModeEdits {
+		properties["edits"] = map[string]any{
+			"type": "array",
+			"items": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"search":     map[string]any{"type": "string"},
+					"replace":    map[string]any{"type": "string"},
+					"start_line": map[string]any{"type": "integer"},
+					"end_line":   map[string]any{"type": "integer"},
+				},
+				"required":             []string{"search", "replace", "start_line", "end_line"},
+				"additionalProperties": false,
+			},
+		}
+		required = append(required, "edits")
+	} else {
+		properties["content"] = map[string]any{"type": "string"}
+		required = append(required, "content")
+	}
+
+	return &providers.ResponseFormat{
+		Name: "verdict",
+		Schema: map[string]any{
+			"type":                 "object",
+			"properties":           properties,
+			"required":             required,
+			"additionalProperties": false,
+		},
+	}
+}
+
+// Parse reads a verdict from the model's reply. Code fences and text around
+// the JSON object are tolerated, as not every provider enforces the format.
+func Parse(reply string) (Verdict, error) {
+	reply = strings.TrimSpace(reply)
+
+	start := strings.Index(reply, "{")
+	end := strings.LastIndex(reply, "}")
+	if start < 0 || end < start {
+		return Verdict{}, errors.New("verdict: reply is not a JSON object")
+	}
+
+	var verdict Verdict
+	if err := json.Unmarshal([]byte(reply[start:end+1]), &verdict); err != nil {
+		return Verdict{}, fmt.Errorf("verdict: failed to decode reply: %w", err)
+	}
+
+	if err := verdict.Validate(); err != nil {
+		return Verdict{}, err
+	}
+
+	return verdict, nil
+}
+
+// Validate checks that the verdict is consistent with its status
+func (v Verdict) Validate() error {
+	switch v.Status {
+	case StatusUnchanged, StatusError:
+	case StatusChanged:
+		if v.Content == "" && len(v.Edits) == 0 {
+			return errors.New("verdict: status is changed but there is no content or edits")
+		}
+	default:
+		return fmt.Errorf("verdict: unknown status '%s'", v.Status)
+	}
+
+	for i, violation := range v.Violations {
+		if violation.Rule == "" {
+			return fmt.Errorf("verdict: violation %d names no rule", i+1)
+		}
+	}
+
+	return nil
+}
+
+// Apply returns the reviewed file: the rewritten content, or the original
+// with the edits applied
+func (v Verdict) Apply(original string) (string, error) {
+	if len(v.Edits) == 0 {
+		return v.Content, nil
+	}
+	return edit.Apply(original, v.Edits)
+}